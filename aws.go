@@ -1,186 +1,318 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/mtlang/cloudwatch_exporter/config"
 )
 
-func getLatestDatapoint(datapoints []*cloudwatch.Datapoint) *cloudwatch.Datapoint {
-	var latest *cloudwatch.Datapoint
+// maxQueriesPerRequest is the maximum number of queries CloudWatch accepts in a single GetMetricData call.
+const maxQueriesPerRequest = 500
+
+// dataQuery is a single series and statistic to request through GetMetricData.
+type dataQuery struct {
+	metric     *config.Metric
+	dimensions []*cloudwatch.Dimension
+	labels     []string
+	statistic  string
+	name       string
+	desc       *prometheus.Desc
+
+	// expression is set for the queries of an expression, refs are then the queries of the metrics it references
+	expression *config.Expression
+	refs       []*dataQuery
+
+	// search is set for SEARCH queries, which return several series, see newSearchQueries
+	search bool
+	tagged taggedResources
+}
+
+// resultKey identifies the results of a series in a GetMetricData call.
+// The series returned by a SEARCH query share its id and are told apart by their label.
+type resultKey struct {
+	id    string
+	label string
+}
+
+// dimensionsKey returns a string identifying the dimensions of a series, to match the series of the metrics of an expression.
+func dimensionsKey(dimensions []*cloudwatch.Dimension) string {
+	pairs := make([]string, 0, len(dimensions))
+	for _, dim := range dimensions {
+		pairs = append(pairs, aws.StringValue(dim.Name)+"="+aws.StringValue(dim.Value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
 
-	for _, datapoint := range datapoints {
-		if latest == nil || latest.Timestamp.Before(*datapoint.Timestamp) {
-			latest = datapoint
+// newExpressionQueries creates one query per series found for all the metrics referenced by the expression.
+// byID maps the ids of the metrics to their queries by dimensions.
+func newExpressionQueries(expression *config.Expression, byID map[string]map[string]*dataQuery) []*dataQuery {
+	var queries []*dataQuery
+
+	for key, first := range byID[expression.References[0]] {
+		refs := []*dataQuery{first}
+		for _, id := range expression.References[1:] {
+			ref, ok := byID[id][key]
+			if !ok {
+				break
+			}
+			refs = append(refs, ref)
 		}
+		if len(refs) != len(expression.References) {
+			continue
+		}
+
+		// The labels of the first metric are kept, without its statistic
+		labels := first.labels[:len(expression.Metric.LabelNames)]
+		queries = append(queries, &dataQuery{
+			metric:     expression.Metric,
+			dimensions: first.dimensions,
+			labels:     labels,
+			name:       expression.Metric.FQNames[""],
+			desc:       expression.Metric.Descs[""],
+			expression: expression,
+			refs:       refs,
+		})
 	}
 
-	return latest
+	return queries
 }
 
-func scrapeTask(collector *Collector, ch chan<- prometheus.Metric, task *config.Task, wg *sync.WaitGroup) {
-	defer wg.Done()
+// dataWindow is the time range over which a group of queries is requested.
+// GetMetricData only accepts a single window per call, so queries are batched by window.
+type dataWindow struct {
+	start time.Time
+	end   time.Time
+}
 
-	var innerWg sync.WaitGroup
+// newDataQueries creates one query per statistic of the metric for the given dimensions.
+// In label mode, the statistic is added as the last label.
+func newDataQueries(metric *config.Metric, dimensions []*cloudwatch.Dimension, labels []string) []*dataQuery {
+	var queries []*dataQuery
 
-	session := session.Must(session.NewSession())
-	var svc *cloudwatch.CloudWatch
-	region := task.Region
-	if len(task.Account) > 0 && len(task.RoleName) > 0 {
-		roleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", task.Account, task.RoleName)
-		roleCreds := stscreds.NewCredentials(session, roleArn)
-		svc = cloudwatch.New(session, aws.NewConfig().WithCredentials(roleCreds).WithRegion(region))
-	} else {
-		svc = cloudwatch.New(session, aws.NewConfig().WithRegion(region))
-	}
+	statistics := append(append([]string{}, metric.Statistics...), metric.ExtendedStatistics...)
+	for _, stat := range statistics {
+		statLabels := labels
+		if metric.StatisticMode == config.StatisticLabel {
+			statLabels = append(append(make([]string, 0, len(labels)+1), labels...), stat)
+		}
 
-	for m := range task.Metrics {
-		configMetric := &task.Metrics[m]
+		queries = append(queries, &dataQuery{
+			metric:     metric,
+			dimensions: dimensions,
+			labels:     statLabels,
+			statistic:  stat,
+			name:       metric.FQNames[stat],
+			desc:       metric.Descs[stat],
+		})
+	}
 
-		now := time.Now()
-		end := now.Add(time.Duration(-configMetric.DelaySeconds) * time.Second)
+	return queries
+}
 
-		params := &cloudwatch.GetMetricStatisticsInput{
-			EndTime:   aws.Time(end),
-			StartTime: aws.Time(end.Add(time.Duration(-configMetric.RangeSeconds) * time.Second)),
-
-			Period:     aws.Int64(int64(configMetric.PeriodSeconds)),
-			MetricName: aws.String(configMetric.Name),
-			Namespace:  aws.String(configMetric.Namespace),
-			Dimensions: []*cloudwatch.Dimension{},
-			Statistics: []*string{},
-			ExtendedStatistics: []*string{},
-			Unit:       nil,
-		}
+// accountLabel returns the value of the account label for an account, which can be empty.
+func accountLabel(account string) string {
+	if len(account) > 0 {
+		return account
+	}
+	return "Not Specified"
+}
 
-		dimensions := []*cloudwatch.Dimension{}
+// appendTaskLabels adds the task, region, account, account name and account metadata labels after the dimension labels.
+func appendTaskLabels(labels []string, task *config.Task) []string {
+	labels = append(labels, task.Name)
+	labels = append(labels, task.Region)
+	labels = append(labels, accountLabel(task.Account))
+	return append(labels, task.LabelValues...)
+}
 
-		//This map will hold dimensions name which has been already collected
-		valueCollected := map[string]bool{}
+// dimensionMatches checks a dimension value against the select regex of the dimension, or its select values if it has no regex.
+func dimensionMatches(configMetric *config.Metric, name string, value string, target string) bool {
+	if regex, ok := configMetric.DimensionsRegexps[name]; ok {
+		return regex.MatchString(value)
+	}
 
-		if len(configMetric.DimensionsSelectRegex) == 0 {
-			configMetric.DimensionsSelectRegex = map[string]string{}
+	for _, selected := range configMetric.DimensionsSelect[name] {
+		// Replace $_target token by the actual URL target
+		if selected == "$_target" {
+			selected = target
 		}
+		if selected == value {
+			return true
+		}
+	}
+	return false
+}
 
-		//Check for dimensions who does not have either select or dimensions select_regex and make them select everything using regex
-		for _, dimension := range configMetric.Dimensions {
-			_, found := configMetric.DimensionsSelect[dimension]
-			_, found2 := configMetric.DimensionsSelectRegex[dimension]
-			if !found && !found2 {
-				configMetric.DimensionsSelectRegex[dimension] = ".*"
+// selectedDimensions returns every combination of the select values of the dimensions, in the configured order.
+// It's only used when all the dimensions have select values and no select regex.
+func selectedDimensions(configMetric *config.Metric, target string) [][]*cloudwatch.Dimension {
+	combinations := [][]*cloudwatch.Dimension{{}}
+
+	for _, name := range configMetric.Dimensions {
+		var next [][]*cloudwatch.Dimension
+		seen := map[string]bool{}
+		for _, value := range configMetric.DimensionsSelect[name] {
+			// Replace $_target token by the actual URL target
+			if value == "$_target" {
+				value = target
+			}
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+
+			for _, combination := range combinations {
+				dimensions := append(make([]*cloudwatch.Dimension, 0, len(configMetric.Dimensions)), combination...)
+				next = append(next, append(dimensions, &cloudwatch.Dimension{
+					Name:  aws.String(name),
+					Value: aws.String(value),
+				}))
 			}
 		}
+		combinations = next
+	}
 
-		for _, stat := range configMetric.Statistics {
-			params.Statistics = append(params.Statistics, aws.String(stat))
-		}
-		for _, stat := range configMetric.ExtendedStatistics {
-			params.ExtendedStatistics = append(params.ExtendedStatistics, aws.String(stat))
+	return combinations
+}
+
+// matchDimensions checks that a metric returned by ListMetrics has exactly the configured dimensions and that they all match.
+// The dimensions and their values are returned in the configured order, so that values line up with the label names.
+func matchDimensions(configMetric *config.Metric, met *cloudwatch.Metric, target string) ([]*cloudwatch.Dimension, []string, bool) {
+	if len(met.Dimensions) != len(configMetric.Dimensions) {
+		return nil, nil, false
+	}
+
+	values := map[string]string{}
+	for _, dim := range met.Dimensions {
+		values[aws.StringValue(dim.Name)] = aws.StringValue(dim.Value)
+	}
+
+	dimensions := make([]*cloudwatch.Dimension, 0, len(configMetric.Dimensions))
+	labels := make([]string, 0, len(configMetric.LabelNames))
+	for _, name := range configMetric.Dimensions {
+		value, ok := values[name]
+		if !ok || !dimensionMatches(configMetric, name, value, target) {
+			return nil, nil, false
 		}
 
-		labels := make([]string, 0, len(task.LabelNames))
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+		labels = append(labels, value)
+	}
 
-		// Loop through the dimensions selects to build the filters and the labels array
-		for dim := range configMetric.DimensionsSelect {
-			for val := range configMetric.DimensionsSelect[dim] {
-				dimValue := configMetric.DimensionsSelect[dim][val]
+	return dimensions, labels, true
+}
 
-				// Replace $_target token by the actual URL target
-				if dimValue == "$_target" {
-					dimValue = collector.Target
-				}
+func scrapeTask(ctx context.Context, collector *Collector, ch chan<- prometheus.Metric, task *config.Task, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-				dimensions = append(dimensions, &cloudwatch.Dimension{
-					Name:  aws.String(dim),
-					Value: aws.String(dimValue),
-				})
+	var innerWg sync.WaitGroup
 
-				labels = append(labels, dimValue)
-			}
-		}
+	svc := clients.getCloudWatch(task.Account, task.RoleName, task.Region)
 
-		if len(dimensions) > 0 || len(configMetric.Dimensions) == 0 {
-			labels = append(labels, task.Name)
-			labels = append(labels, region)
-			account := task.Account
-			if len(account) > 0 {
-				labels = append(labels, account)
-			} else {
-				labels = append(labels, "Not Specified")
+	queries := map[dataWindow][]*dataQuery{}
+
+	// Queries of the metrics with an id, by dimensions, and their window, for the expressions of the task
+	byID := map[string]map[string]*dataQuery{}
+	windows := map[string]dataWindow{}
+	addQueries := func(window dataWindow, metricQueries []*dataQuery) {
+		queries[window] = append(queries[window], metricQueries...)
+		for _, query := range metricQueries {
+			if id := query.metric.ID; id != "" {
+				if byID[id] == nil {
+					byID[id] = map[string]*dataQuery{}
+				}
+				byID[id][dimensionsKey(query.dimensions)] = query
+				windows[id] = window
 			}
-			params.Dimensions = dimensions
-			labels = append(labels, "")
-			innerWg.Add(1)
-			scrapeSingleDataPoint(collector, ch, *params, task, labels, svc, &innerWg)
 		}
+	}
 
-		//If no regex is specified, continue
-		if len(configMetric.DimensionsSelectRegex) == 0 {
-			continue
+	// All the metrics share the same end time, so that metrics with the same range and delay are requested together
+	now := time.Now()
+
+	for m := range task.Metrics {
+		// Don't start discovering more series once the scrape deadline passed
+		if ctx.Err() != nil {
+			break
 		}
 
-		// Get all the metric to select the ones who'll match the regex
-		result, err := svc.ListMetrics(&cloudwatch.ListMetricsInput{
-			MetricName: aws.String(configMetric.Name),
-			Namespace:  aws.String(configMetric.Namespace),
-		})
-		if err != nil {
-			fmt.Println(err)
-			continue
+		configMetric := &task.Metrics[m]
+
+		end := now.Add(time.Duration(-configMetric.DelaySeconds) * time.Second)
+		window := dataWindow{
+			start: end.Add(time.Duration(-configMetric.RangeSeconds) * time.Second),
+			end:   end,
 		}
-		nextToken := result.NextToken
-		metrics := result.Metrics
-		totalRequests.Inc()
 
-		for nextToken != nil {
-			result, err := svc.ListMetrics(&cloudwatch.ListMetricsInput{
-				MetricName: aws.String(configMetric.Name),
-				Namespace:  aws.String(configMetric.Namespace),
-				NextToken:  nextToken,
-			})
+		// Resources selected by their tags, and the values of their exported tags
+		var tagged taggedResources
+		if configMetric.TagSelect != nil {
+			var err error
+			tagged, err = getTaggedResources(ctx, collector, task, configMetric)
 			if err != nil {
-				fmt.Println(err)
+				if ctx.Err() == nil {
+					fmt.Println(err)
+				}
 				continue
 			}
-			nextToken = result.NextToken
-			metrics = append(metrics, result.Metrics...)
 		}
 
-		//For each metric returned by aws
-		for _, met := range result.Metrics {
-			labels := make([]string, 0, len(task.LabelNames))
-			dimensions = []*cloudwatch.Dimension{}
-
-			//Try to match each dimensions to the regex
-			for _, dim := range met.Dimensions {
-				dimRegex := configMetric.DimensionsSelectRegex[*dim.Name]
-				if dimRegex == "" {
-					dimRegex = "\\b" + strings.Join(configMetric.DimensionsSelect[*dim.Name], "\\b|\\b") + "\\b"
-				}
+		// SEARCH queries find the dimensions themselves, ListMetrics isn't needed
+		if configMetric.Search {
+			addQueries(window, newSearchQueries(configMetric, task, tagged))
+			continue
+		}
 
-				match, _ := regexp.MatchString(dimRegex, *dim.Value)
-				if match {
-					dimensions = append(dimensions, &cloudwatch.Dimension{
-						Name:  aws.String(*dim.Name),
-						Value: aws.String(*dim.Value),
-					})
-					labels = append(labels, *dim.Value)
+		// When every dimension is selected by value, the series are known and requested without listing them
+		if len(configMetric.DimensionsSelectRegex) == 0 {
+			for _, dimensions := range selectedDimensions(configMetric, collector.Target) {
+				tagLabels, ok := tagged.tagLabels(configMetric, dimensions)
+				if !ok {
+					continue
+				}
 
+				labels := make([]string, 0, len(configMetric.LabelNames))
+				for _, dimension := range dimensions {
+					labels = append(labels, aws.StringValue(dimension.Value))
 				}
+				labels = append(labels, tagLabels...)
+				labels = appendTaskLabels(labels, task)
+				addQueries(window, newDataQueries(configMetric, dimensions, labels))
 			}
+			continue
+		}
+
+		//This map will hold dimensions name which has been already collected
+		valueCollected := map[string]bool{}
+
+		// Get all the metric to select the ones who'll match the regex
+		metrics, err := listMetrics(ctx, collector, svc, configMetric, task, collector.Target)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+
+		//For each metric returned by aws
+		for _, met := range metrics {
+			dimensions, labels, match := matchDimensions(configMetric, met, collector.Target)
 
 			//Cheking if all dimensions matched
-			if len(labels) == len(configMetric.Dimensions) {
+			if match {
 
 				//Checking if this couple of dimensions has already been scraped
 				if _, ok := valueCollected[strings.Join(labels, ";")]; ok {
@@ -190,87 +322,232 @@ func scrapeTask(collector *Collector, ch chan<- prometheus.Metric, task *config.
 				//If no, then scrape them
 				valueCollected[strings.Join(labels, ";")] = true
 
-				params.Dimensions = dimensions
-
-				labels = append(labels, task.Name)
-				labels = append(labels, region)
-				account := task.Account
-				if len(account) > 0 {
-					labels = append(labels, account)
-				} else {
-					labels = append(labels, "Not Specified")
+				tagLabels, ok := tagged.tagLabels(configMetric, dimensions)
+				if !ok {
+					continue
 				}
-				labels = append(labels, "")
-				innerWg.Add(1)
-				go scrapeSingleDataPoint(collector, ch, *params, task, labels, svc, &innerWg)
+				labels = append(labels, tagLabels...)
+				labels = appendTaskLabels(labels, task)
+				addQueries(window, newDataQueries(configMetric, dimensions, labels))
 			}
 
 		}
 	}
+
+	// The metrics of an expression share their window, see config.Expression
+	for e := range task.Expressions {
+		expression := &task.Expressions[e]
+		if window, ok := windows[expression.References[0]]; ok {
+			queries[window] = append(queries[window], newExpressionQueries(expression, byID)...)
+		}
+	}
+
+	// Send the queries in batches, one GetMetricData call per batch
+	for window, windowQueries := range queries {
+		for _, batch := range batchQueries(windowQueries) {
+			innerWg.Add(1)
+			go scrapeDataQueries(ctx, collector, ch, window, batch, task, svc, &innerWg)
+		}
+	}
 	innerWg.Wait()
 }
 
+// batchQueries splits the queries of a window into batches of at most maxQueriesPerRequest queries.
+// An expression is sent in the same batch as the queries of its metrics, which must be in the list, so that it references them by their ids.
+func batchQueries(queries []*dataQuery) [][]*dataQuery {
+	// Queries linked by expressions form a group, which is never split
+	groupOf := map[*dataQuery]int{}
+	var groups [][]*dataQuery
+	for _, query := range queries {
+		if query.expression == nil {
+			groupOf[query] = len(groups)
+			groups = append(groups, []*dataQuery{query})
+		}
+	}
+	for _, query := range queries {
+		if query.expression == nil {
+			continue
+		}
+
+		group := groupOf[query.refs[0]]
+		for _, ref := range query.refs[1:] {
+			other := groupOf[ref]
+			if other == group {
+				continue
+			}
+			for _, moved := range groups[other] {
+				groupOf[moved] = group
+			}
+			groups[group] = append(groups[group], groups[other]...)
+			groups[other] = nil
+		}
+		groupOf[query] = group
+		groups[group] = append(groups[group], query)
+	}
+
+	var batches [][]*dataQuery
+	var batch []*dataQuery
+	for _, group := range groups {
+		if len(batch) > 0 && len(batch)+len(group) > maxQueriesPerRequest {
+			batches = append(batches, batch)
+			batch = nil
+		}
+		batch = append(batch, group...)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
 // scrape makes the required calls to AWS CloudWatch by using the parameters in the cwCollector
 // Once converted into Prometheus format, the metrics are pushed on the ch channel.
-func scrape(collector *Collector, ch chan<- prometheus.Metric) {
+func scrape(ctx context.Context, collector *Collector, ch chan<- prometheus.Metric) {
 	var wg sync.WaitGroup
 	for _, task := range collector.Tasks {
 		wg.Add(1)
-		go scrapeTask(collector, ch, task, &wg)
+		go scrapeTask(ctx, collector, ch, task, &wg)
 	}
 	wg.Wait()
 }
 
-//Send a single dataPoint to the Prometheus lib
-func scrapeSingleDataPoint(collector *Collector, ch chan<- prometheus.Metric, params cloudwatch.GetMetricStatisticsInput, task *config.Task, labels []string, svc *cloudwatch.CloudWatch, wg *sync.WaitGroup) error {
+// scrapeDataQueries requests a batch of queries through GetMetricData and sends the datapoints of each series to the Prometheus lib.
+// All the queries must share the same window and be at most maxQueriesPerRequest long.
+func scrapeDataQueries(ctx context.Context, collector *Collector, ch chan<- prometheus.Metric, window dataWindow, queries []*dataQuery, task *config.Task, svc *cloudwatch.CloudWatch, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	resp, err := svc.GetMetricStatistics(&params)
-	totalRequests.Inc()
-
-	if err != nil {
-		collector.ErroneousRequests.Inc()
-		fmt.Println(fmt.Sprintf("%s - %s - %s:%s", task.Account, task.Region, *params.Dimensions[0].Name, *params.Dimensions[0].Value))
-		fmt.Println(err)
-		return err
-	}
 
-	// There's nothing in there, don't publish the metric
-	if len(resp.Datapoints) == 0 {
-		return nil
+	params := &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(window.start),
+		EndTime:           aws.Time(window.end),
+		MetricDataQueries: make([]*cloudwatch.MetricDataQuery, 0, len(queries)),
 	}
-	// Pick the latest datapoint
-	dp := getLatestDatapoint(resp.Datapoints)
 
-	if dp.Sum != nil {
-		labels[len(labels)-1] = "Sum"
-		ch <- prometheus.MustNewConstMetric(task.Desc, task.ValType, *dp.Sum, labels...)
-	}
+	// Query IDs must start with a lowercase letter, the index is used to map the results back
+	queryByID := make(map[string]*dataQuery, len(queries))
+	idByQuery := make(map[*dataQuery]string, len(queries))
+	for _, query := range queries {
+		if query.expression != nil {
+			continue
+		}
 
-	if dp.Average != nil {
-		labels[len(labels)-1] = "Average"
-		ch <- prometheus.MustNewConstMetric(task.Desc, task.ValType, *dp.Average, labels...)
+		id := fmt.Sprintf("q%d", len(params.MetricDataQueries))
+		queryByID[id] = query
+		idByQuery[query] = id
+		if query.search {
+			params.MetricDataQueries = append(params.MetricDataQueries, &cloudwatch.MetricDataQuery{
+				Id:         aws.String(id),
+				Expression: aws.String(searchExpression(query.metric, query.statistic, collector.Target)),
+				Label:      aws.String(searchLabel(query.metric)),
+			})
+		} else {
+			params.MetricDataQueries = append(params.MetricDataQueries, metricStatQuery(id, query))
+		}
 	}
 
-	if dp.Maximum != nil {
-		labels[len(labels)-1] = "Maximum"
-		ch <- prometheus.MustNewConstMetric(task.Desc, task.ValType, *dp.Maximum, labels...)
-	}
+	// Expressions reference the queries of their metrics, which are in the same batch, by their ids
+	for _, query := range queries {
+		if query.expression == nil {
+			continue
+		}
+
+		ids := map[string]string{}
+		for _, ref := range query.refs {
+			ids[ref.metric.ID] = idByQuery[ref]
+		}
 
-	if dp.Minimum != nil {
-		labels[len(labels)-1] = "Minimum"
-		ch <- prometheus.MustNewConstMetric(task.Desc, task.ValType, *dp.Minimum, labels...)
+		id := fmt.Sprintf("q%d", len(params.MetricDataQueries))
+		queryByID[id] = query
+		params.MetricDataQueries = append(params.MetricDataQueries, &cloudwatch.MetricDataQuery{
+			Id:         aws.String(id),
+			Expression: aws.String(query.expression.Rewrite(ids)),
+		})
 	}
 
-	if dp.SampleCount != nil {
-		labels[len(labels)-1] = "SampleCount"
-		ch <- prometheus.MustNewConstMetric(task.Desc, task.ValType, *dp.SampleCount, labels...)
+	// Results of a single query can be split across several pages
+	datapoints := map[resultKey][]datapoint{}
+
+	for {
+		resp, err := svc.GetMetricDataWithContext(ctx, params, limiter.attempts(apiGetMetricData, task.Account, task.Region))
+		totalRequests.Inc()
+
+		if err != nil {
+			// Calls cancelled by the scrape deadline aren't errors, the scrape is marked as timed out instead
+			if ctx.Err() != nil {
+				return err
+			}
+			collector.ErroneousRequests.Inc()
+			fmt.Println(fmt.Sprintf("%s - %s - %d queries", task.Account, task.Region, len(queries)))
+			fmt.Println(err)
+			return err
+		}
+
+		for _, result := range resp.MetricDataResults {
+			key := resultKey{id: aws.StringValue(result.Id)}
+			query := queryByID[key.id]
+			if query == nil {
+				continue
+			}
+			if query.search {
+				key.label = aws.StringValue(result.Label)
+			}
+			for i, timestamp := range result.Timestamps {
+				if i >= len(result.Values) || timestamp == nil || result.Values[i] == nil {
+					continue
+				}
+				datapoints[key] = append(datapoints[key], datapoint{
+					timestamp: *timestamp,
+					value:     *result.Values[i] * query.metric.UnitFactors[query.statistic],
+				})
+			}
+		}
+
+		if resp.NextToken == nil {
+			break
+		}
+		params.NextToken = resp.NextToken
 	}
 
-	if dp.ExtendedStatistics != nil {
-		for statisticName, statisticValue := range dp.ExtendedStatistics {
-			labels[len(labels)-1] = statisticName
-			ch <- prometheus.MustNewConstMetric(task.Desc, task.ValType, *statisticValue, labels...)
+	for key, queryDatapoints := range datapoints {
+		query := queryByID[key.id]
+		if query.search {
+			var ok bool
+			query, ok = searchSeriesQuery(query, key.label, collector.Target)
+			if !ok {
+				continue
+			}
 		}
+
+		sortDatapoints(queryDatapoints)
+		sendDatapoints(collector, ch, query, queryDatapoints)
 	}
 	return nil
 }
+
+// metricStatQuery returns the GetMetricData query of a single metric and statistic.
+func metricStatQuery(id string, query *dataQuery) *cloudwatch.MetricDataQuery {
+	dataQuery := &cloudwatch.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &cloudwatch.MetricStat{
+			Metric: &cloudwatch.Metric{
+				Namespace:  aws.String(query.metric.Namespace),
+				MetricName: aws.String(query.metric.Name),
+				Dimensions: query.dimensions,
+			},
+			Period: aws.Int64(int64(query.metric.PeriodSeconds)),
+			Stat:   aws.String(query.statistic),
+		},
+	}
+	if query.metric.Unit != "" {
+		dataQuery.MetricStat.Unit = aws.String(query.metric.Unit)
+	}
+	return dataQuery
+}
+
+// setTimestamp returns true if the samples of the metric carry the timestamp of their CloudWatch datapoint.
+// Metrics which don't set set_timestamp use the exporter-wide default.
+func setTimestamp(configMetric *config.Metric) bool {
+	if configMetric.SetTimestamp != nil {
+		return *configMetric.SetTimestamp
+	}
+	return *defaultSetTimestamp
+}
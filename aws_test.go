@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// dimensionStrings returns the dimension sets as name=value strings.
+func dimensionStrings(combinations [][]*cloudwatch.Dimension) [][]string {
+	result := [][]string{}
+	for _, dimensions := range combinations {
+		strs := []string{}
+		for _, dimension := range dimensions {
+			strs = append(strs, aws.StringValue(dimension.Name)+"="+aws.StringValue(dimension.Value))
+		}
+		result = append(result, strs)
+	}
+	return result
+}
+
+func TestSelectedDimensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		dimensions []string
+		selects    map[string][]string
+		expected   [][]string
+	}{
+		{
+			name:     "no dimensions",
+			expected: [][]string{{}},
+		},
+		{
+			name:       "single value",
+			dimensions: []string{"FunctionName"},
+			selects:    map[string][]string{"FunctionName": {"foo"}},
+			expected:   [][]string{{"FunctionName=foo"}},
+		},
+		{
+			name:       "several values",
+			dimensions: []string{"FunctionName"},
+			selects:    map[string][]string{"FunctionName": {"foo", "bar", "foo"}},
+			expected:   [][]string{{"FunctionName=foo"}, {"FunctionName=bar"}},
+		},
+		{
+			name:       "configured order",
+			dimensions: []string{"FunctionName", "Resource"},
+			selects:    map[string][]string{"Resource": {"r1", "r2"}, "FunctionName": {"foo", "bar"}},
+			expected: [][]string{
+				{"FunctionName=foo", "Resource=r1"},
+				{"FunctionName=bar", "Resource=r1"},
+				{"FunctionName=foo", "Resource=r2"},
+				{"FunctionName=bar", "Resource=r2"},
+			},
+		},
+		{
+			name:       "target",
+			dimensions: []string{"InstanceId"},
+			selects:    map[string][]string{"InstanceId": {"$_target"}},
+			expected:   [][]string{{"InstanceId=i-123"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metric := &config.Metric{Dimensions: test.dimensions, DimensionsSelect: test.selects}
+			actual := dimensionStrings(selectedDimensions(metric, "i-123"))
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNewExpressionQueries(t *testing.T) {
+	// query returns the query of a metric for a function, in label mode
+	query := func(id string, function string) *dataQuery {
+		return &dataQuery{
+			metric:     &config.Metric{ID: id},
+			dimensions: []*cloudwatch.Dimension{{Name: aws.String("FunctionName"), Value: aws.String(function)}},
+			labels:     []string{function, "lambda", "Sum"},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		errors      []string
+		invocations []string
+		expected    []string
+	}{
+		{
+			name:        "series of every metric",
+			errors:      []string{"api", "worker"},
+			invocations: []string{"worker", "api"},
+			expected:    []string{"api", "worker"},
+		},
+		{
+			name:        "series missing a metric",
+			errors:      []string{"api", "worker"},
+			invocations: []string{"worker", "cron"},
+			expected:    []string{"worker"},
+		},
+		{
+			name:   "no series",
+			errors: []string{"api"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			byID := map[string]map[string]*dataQuery{"errors": {}, "invocations": {}}
+			for _, function := range test.errors {
+				errors := query("errors", function)
+				byID["errors"][dimensionsKey(errors.dimensions)] = errors
+			}
+			for _, function := range test.invocations {
+				invocations := query("invocations", function)
+				byID["invocations"][dimensionsKey(invocations.dimensions)] = invocations
+			}
+
+			expression := &config.Expression{
+				ID:         "error_rate",
+				References: []string{"errors", "invocations"},
+				Metric:     &config.Metric{LabelNames: []string{"function_name", "task"}, FQNames: map[string]string{"": "error_rate"}},
+			}
+			queries := newExpressionQueries(expression, byID)
+			sort.Slice(queries, func(i, j int) bool { return queries[i].labels[0] < queries[j].labels[0] })
+
+			functions := []string{}
+			for _, query := range queries {
+				function := query.labels[0]
+				functions = append(functions, function)
+
+				// The statistic label of the first metric is removed
+				if !reflect.DeepEqual(query.labels, []string{function, "lambda"}) {
+					t.Errorf("%s: expected labels [%s lambda], got %v", function, function, query.labels)
+				}
+				key := dimensionsKey(query.dimensions)
+				if len(query.refs) != 2 || query.refs[0] != byID["errors"][key] || query.refs[1] != byID["invocations"][key] {
+					t.Errorf("%s: expected the queries of the metrics of the function, got %v", function, query.refs)
+				}
+			}
+			if len(test.expected) == 0 {
+				test.expected = []string{}
+			}
+			if !reflect.DeepEqual(functions, test.expected) {
+				t.Errorf("expected queries for %v, got %v", test.expected, functions)
+			}
+		})
+	}
+}
+
+func TestBatchQueries(t *testing.T) {
+	// queries returns n queries of metrics which aren't used by expressions
+	queries := func(n int) []*dataQuery {
+		result := make([]*dataQuery, n)
+		for i := range result {
+			result[i] = &dataQuery{metric: &config.Metric{}}
+		}
+		return result
+	}
+	expression := func(refs ...*dataQuery) *dataQuery {
+		return &dataQuery{expression: &config.Expression{}, refs: refs}
+	}
+
+	tests := []struct {
+		name     string
+		queries  func() []*dataQuery
+		expected []int
+	}{
+		{
+			name:     "single batch",
+			queries:  func() []*dataQuery { return queries(500) },
+			expected: []int{500},
+		},
+		{
+			name:     "split at the limit",
+			queries:  func() []*dataQuery { return queries(1201) },
+			expected: []int{500, 500, 201},
+		},
+		{
+			name: "expression with its metrics",
+			queries: func() []*dataQuery {
+				metrics := queries(2)
+				return append(metrics, expression(metrics...))
+			},
+			expected: []int{3},
+		},
+		{
+			name: "expression kept with its metrics at the limit",
+			queries: func() []*dataQuery {
+				metrics := queries(2)
+				return append(append(queries(499), metrics...), expression(metrics...))
+			},
+			expected: []int{499, 3},
+		},
+		{
+			name: "expressions sharing a metric",
+			queries: func() []*dataQuery {
+				metrics := queries(3)
+				all := append(queries(497), metrics[0])
+				all = append(all, expression(metrics[1], metrics[2]), metrics[1], metrics[2])
+				return append(all, expression(metrics[0], metrics[1]))
+			},
+			expected: []int{497, 5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			all := test.queries()
+			batches := batchQueries(all)
+
+			sizes := []int{}
+			batchOf := map[*dataQuery]int{}
+			for b, batch := range batches {
+				sizes = append(sizes, len(batch))
+				for _, query := range batch {
+					batchOf[query] = b
+				}
+			}
+			if !reflect.DeepEqual(sizes, test.expected) {
+				t.Errorf("expected batches of %v queries, got %v", test.expected, sizes)
+			}
+			if len(batchOf) != len(all) {
+				t.Errorf("expected every query to be sent once, %d of %d are", len(batchOf), len(all))
+			}
+
+			// Expressions reference their metrics by their ids in the batch
+			for _, query := range all {
+				for _, ref := range query.refs {
+					if batchOf[ref] != batchOf[query] {
+						t.Errorf("expected an expression to be sent with its metrics, got batches %d and %d", batchOf[query], batchOf[ref])
+					}
+				}
+			}
+		})
+	}
+}
+
+// getMetricDataResult is a series returned by the fake GetMetricData endpoint, its values are at the given minutes.
+type getMetricDataResult struct {
+	id      string
+	label   string
+	minutes []int
+	values  []float64
+}
+
+func TestScrapeDataQueries(t *testing.T) {
+	// The request metrics are created by main
+	totalRequests = prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "Requests"})
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "queue_wait_seconds", Help: "Queue wait"}, []string{"api"})
+	throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "throttled_requests_total", Help: "Throttled"}, []string{"api"})
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "retries_total", Help: "Retries"}, []string{"api", "code"})
+	limiter = newAPILimiter(0, map[string]float64{})
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The results are split across two pages, the first series has datapoints in both
+	pages := [][]getMetricDataResult{
+		{
+			{id: "q0", minutes: []int{0, 1}, values: []float64{1, 2}},
+			{id: "q1", label: "api", minutes: []int{1}, values: []float64{100}},
+			{id: "q1", label: "worker", minutes: []int{1}, values: []float64{200}},
+			{id: "unknown", minutes: []int{1}, values: []float64{1}},
+		},
+		{
+			{id: "q0", minutes: []int{2}, values: []float64{3}},
+			{id: "q2", minutes: []int{2}, values: []float64{300}},
+		},
+	}
+
+	var requested url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		page, token := 0, ""
+		if req.Form.Get("NextToken") == "" {
+			requested = req.Form
+			token = "<NextToken>next</NextToken>"
+		} else {
+			page = 1
+		}
+
+		results := ""
+		for _, result := range pages[page] {
+			timestamps, values := "", ""
+			for i, minute := range result.minutes {
+				timestamps += fmt.Sprintf("<member>%s</member>", start.Add(time.Duration(minute)*time.Minute).Format(time.RFC3339))
+				values += fmt.Sprintf("<member>%g</member>", result.values[i])
+			}
+			results += fmt.Sprintf("<member><Id>%s</Id><Label>%s</Label><Timestamps>%s</Timestamps><Values>%s</Values><StatusCode>Complete</StatusCode></member>", result.id, result.label, timestamps, values)
+		}
+		fmt.Fprintf(w, "<GetMetricDataResponse><GetMetricDataResult><MetricDataResults>%s</MetricDataResults>%s</GetMetricDataResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></GetMetricDataResponse>", results, token)
+	}))
+	defer server.Close()
+
+	svc := cloudwatch.New(session.Must(session.NewSession(withRetryer(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+	}))))
+
+	// The names of the series by descriptor
+	errorsDesc := prometheus.NewDesc("aws_lambda_errors", "Errors", []string{"function_name", "task", "statistic"}, nil)
+	durationDesc := prometheus.NewDesc("aws_lambda_duration_seconds", "Duration", []string{"function_name", "task", "statistic"}, nil)
+	expressionDesc := prometheus.NewDesc("error_count", "errors * 100", []string{"function_name", "task"}, nil)
+	names := map[*prometheus.Desc]string{errorsDesc: "aws_lambda_errors", durationDesc: "aws_lambda_duration_seconds", expressionDesc: "error_count"}
+
+	errorsMetric := &config.Metric{
+		ID:             "errors",
+		Namespace:      "AWS/Lambda",
+		Name:           "Errors",
+		Dimensions:     []string{"FunctionName"},
+		PeriodSeconds:  60,
+		DatapointsMode: config.DatapointsLatest,
+		ValType:        prometheus.GaugeValue,
+		UnitFactors:    map[string]float64{"Sum": 1},
+	}
+	durationMetric := &config.Metric{
+		Namespace:         "AWS/Lambda",
+		Name:              "Duration",
+		Dimensions:        []string{"FunctionName"},
+		PeriodSeconds:     60,
+		DatapointsMode:    config.DatapointsLatest,
+		ValType:           prometheus.GaugeValue,
+		UnitFactors:       map[string]float64{"Average": 1e-3},
+		DimensionsRegexps: map[string]*regexp.Regexp{"FunctionName": regexp.MustCompile(".*")},
+	}
+	expression := &config.Expression{
+		ID:         "error_count",
+		Expression: "errors * 100",
+		Metric:     &config.Metric{DatapointsMode: config.DatapointsLatest, ValType: prometheus.GaugeValue, UnitFactors: map[string]float64{"": 1}},
+	}
+
+	errors := &dataQuery{
+		metric:     errorsMetric,
+		dimensions: []*cloudwatch.Dimension{{Name: aws.String("FunctionName"), Value: aws.String("api")}},
+		labels:     []string{"api", "lambda", "Sum"},
+		statistic:  "Sum",
+		desc:       errorsDesc,
+	}
+	queries := []*dataQuery{
+		errors,
+		{metric: durationMetric, labels: []string{"lambda", "Average"}, statistic: "Average", desc: durationDesc, search: true},
+		{metric: expression.Metric, labels: []string{"api", "lambda"}, desc: expressionDesc, expression: expression, refs: []*dataQuery{errors}},
+	}
+
+	collector := &Collector{ErroneousRequests: prometheus.NewGauge(prometheus.GaugeOpts{Name: "erroneous_requests", Help: "Erroneous requests"})}
+	ch := make(chan prometheus.Metric, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	window := dataWindow{start: start, end: start.Add(10 * time.Minute)}
+	if err := scrapeDataQueries(context.Background(), collector, ch, window, queries, &config.Task{Region: "eu-west-1"}, svc, &wg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	close(ch)
+
+	// The expression references the query of its metric, which isn't requested a second time
+	if expected := []string{"q0", "q1", "q2"}; !reflect.DeepEqual(requestedIDs(requested), expected) {
+		t.Errorf("expected the queries %v, got %v", expected, requestedIDs(requested))
+	}
+	if expression := requested.Get("MetricDataQueries.member.3.Expression"); expression != "q0 * 100" {
+		t.Errorf("expected the expression q0 * 100, got %s", expression)
+	}
+
+	// Each series gets the datapoints of its id, and of its label for the SEARCH query, across pages.
+	// The label values are sorted by label name.
+	samples := []string{}
+	for metric := range ch {
+		sample := &dto.Metric{}
+		metric.Write(sample)
+		labels := []string{}
+		for _, label := range sample.Label {
+			labels = append(labels, label.GetValue())
+		}
+		samples = append(samples, fmt.Sprintf("%s%v %g", names[metric.Desc()], labels, sample.GetGauge().GetValue()))
+	}
+	sort.Strings(samples)
+	expected := []string{
+		"aws_lambda_duration_seconds[api Average lambda] 0.1",
+		"aws_lambda_duration_seconds[worker Average lambda] 0.2",
+		"aws_lambda_errors[api Sum lambda] 3",
+		"error_count[api lambda] 300",
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("expected samples %v, got %v", expected, samples)
+	}
+}
+
+// requestedIDs returns the ids of the queries of a GetMetricData request.
+func requestedIDs(form url.Values) []string {
+	ids := []string{}
+	for i := 1; form.Get(fmt.Sprintf("MetricDataQueries.member.%d.Id", i)) != ""; i++ {
+		ids = append(ids, form.Get(fmt.Sprintf("MetricDataQueries.member.%d.Id", i)))
+	}
+	return ids
+}
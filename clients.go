@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// credentialsExpiryWindow is how long before their expiry assumed-role credentials are refreshed.
+const credentialsExpiryWindow = 2 * time.Minute
+
+// credentialsKey identifies the role assumed in an account.
+type credentialsKey struct {
+	account  string
+	roleName string
+}
+
+// clientKey identifies a client created for a role and a region.
+type clientKey struct {
+	credentialsKey
+	region string
+}
+
+// clientCache shares a single AWS session across scrapes and caches the clients created from it.
+// Assumed-role credentials are shared by all the regions of an account and refreshed before they expire.
+type clientCache struct {
+	mutex       sync.Mutex
+	session     *session.Session
+	credentials map[credentialsKey]*credentials.Credentials
+	cloudwatch  map[clientKey]*cloudwatch.CloudWatch
+}
+
+var clients = newClientCache()
+
+func newClientCache() *clientCache {
+	return &clientCache{
+		credentials: map[credentialsKey]*credentials.Credentials{},
+		cloudwatch:  map[clientKey]*cloudwatch.CloudWatch{},
+	}
+}
+
+// assumeRoleProvider counts the calls made to STS and the errors they return for an account.
+type assumeRoleProvider struct {
+	*stscreds.AssumeRoleProvider
+	account string
+}
+
+// Retrieve assumes the role and counts the call.
+func (provider *assumeRoleProvider) Retrieve() (credentials.Value, error) {
+	return provider.RetrieveWithContext(aws.BackgroundContext())
+}
+
+// RetrieveWithContext assumes the role and counts the call.
+// The credentials call it rather than Retrieve, so it must be overridden too.
+func (provider *assumeRoleProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	stsRequests.WithLabelValues(provider.account).Inc()
+
+	value, err := provider.AssumeRoleProvider.RetrieveWithContext(ctx)
+	if err != nil {
+		credentialErrors.WithLabelValues(provider.account).Inc()
+	}
+	return value, err
+}
+
+// getSession returns the session shared by every client. The lock must be held by the caller.
+func (cache *clientCache) getSession() *session.Session {
+	if cache.session == nil {
+		cache.session = session.Must(session.NewSession())
+	}
+	return cache.session
+}
+
+// config returns the configuration to use for a client in the given account and region.
+// The lock must be held by the caller.
+func (cache *clientCache) config(account string, roleName string, region string) *aws.Config {
+	cfg := withRetryer(aws.NewConfig().WithRegion(region))
+	if len(account) == 0 || len(roleName) == 0 {
+		return cfg
+	}
+
+	key := credentialsKey{account: account, roleName: roleName}
+	creds, ok := cache.credentials[key]
+	if !ok {
+		roleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", account, roleName)
+		creds = credentials.NewCredentials(&assumeRoleProvider{
+			AssumeRoleProvider: &stscreds.AssumeRoleProvider{
+				Client:          sts.New(cache.getSession(), withRetryer(aws.NewConfig())),
+				RoleARN:         roleArn,
+				RoleSessionName: "cloudwatch_exporter",
+				Duration:        stscreds.DefaultDuration,
+				ExpiryWindow:    credentialsExpiryWindow,
+			},
+			account: account,
+		})
+		cache.credentials[key] = creds
+	}
+
+	return cfg.WithCredentials(creds)
+}
+
+// getCloudWatch returns the CloudWatch client for a role in an account and region, creating it if needed.
+// When the account or role name are empty, the default credential chain is used.
+func (cache *clientCache) getCloudWatch(account string, roleName string, region string) *cloudwatch.CloudWatch {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	key := clientKey{credentialsKey{account: account, roleName: roleName}, region}
+	if svc, ok := cache.cloudwatch[key]; ok {
+		clientCacheHits.WithLabelValues(accountLabel(account)).Inc()
+		return svc
+	}
+
+	svc := cloudwatch.New(cache.getSession(), cache.config(account, roleName, region))
+	cache.cloudwatch[key] = svc
+	return svc
+}
+
+// getEC2 returns a new EC2 client for a role in an account and region.
+// EC2 is only used when generating tasks, so its clients aren't cached.
+func (cache *clientCache) getEC2(account string, roleName string, region string) *ec2.EC2 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return ec2.New(cache.getSession(), cache.config(account, roleName, region))
+}
+
+// getOrganizations returns a new Organizations client for a role in the management account.
+// The endpoint can be overridden, for example to use a local fake of the API.
+func (cache *clientCache) getOrganizations(account string, roleName string, endpoint string) *organizations.Organizations {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cfg := cache.config(account, roleName, "us-east-1")
+	if len(endpoint) > 0 {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	return organizations.New(cache.getSession(), cfg)
+}
+
+// getTagging returns a new Resource Groups Tagging API client for a role in an account and region.
+func (cache *clientCache) getTagging(account string, roleName string, region string) *resourcegroupstaggingapi.ResourceGroupsTaggingAPI {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return resourcegroupstaggingapi.New(cache.getSession(), cache.config(account, roleName, region))
+}
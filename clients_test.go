@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the value of the counter of a vector with the given label values.
+func counterValue(vec *prometheus.CounterVec, labels ...string) float64 {
+	metric := &dto.Metric{}
+	vec.WithLabelValues(labels...).Write(metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestAssumeRoleProvider(t *testing.T) {
+	// The client metrics are created by main
+	stsRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sts_requests_total", Help: "STS requests"}, []string{"account"})
+	credentialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "credential_errors_total", Help: "Credential errors"}, []string{"account"})
+
+	// Roles in the account 222 can't be assumed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if strings.Contains(req.Form.Get("RoleArn"), "::222:") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>Not authorized</Message></Error><RequestId>1</RequestId></ErrorResponse>"))
+			return
+		}
+		w.Write([]byte("<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>assumed</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleResult><ResponseMetadata><RequestId>2</RequestId></ResponseMetadata></AssumeRoleResponse>"))
+	}))
+	defer server.Close()
+
+	client := sts.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+	assume := func(account string) *credentials.Credentials {
+		return credentials.NewCredentials(&assumeRoleProvider{
+			AssumeRoleProvider: &stscreds.AssumeRoleProvider{
+				Client:          client,
+				RoleARN:         "arn:aws:iam::" + account + ":role/exporter",
+				RoleSessionName: "cloudwatch_exporter",
+				Duration:        stscreds.DefaultDuration,
+				ExpiryWindow:    credentialsExpiryWindow,
+			},
+			account: account,
+		})
+	}
+
+	// The credentials are only requested once, until they expire
+	creds := assume("111")
+	for i := 0; i < 2; i++ {
+		value, err := creds.Get()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if value.AccessKeyID != "assumed" {
+			t.Errorf("expected the assumed credentials, got %s", value.AccessKeyID)
+		}
+	}
+	if requests := counterValue(stsRequests, "111"); requests != 1 {
+		t.Errorf("expected 1 STS request in 111, got %g", requests)
+	}
+	if errors := counterValue(credentialErrors, "111"); errors != 0 {
+		t.Errorf("expected no credential error in 111, got %g", errors)
+	}
+
+	if _, err := assume("222").Get(); err == nil {
+		t.Error("expected an error assuming a role in 222")
+	}
+	if requests := counterValue(stsRequests, "222"); requests != 1 {
+		t.Errorf("expected 1 STS request in 222, got %g", requests)
+	}
+	if errors := counterValue(credentialErrors, "222"); errors != 1 {
+		t.Errorf("expected 1 credential error in 222, got %g", errors)
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/mtlang/cloudwatch_exporter/config"
@@ -17,13 +17,25 @@ import (
 type Collector struct {
 	Target            string
 	ScrapeTime        prometheus.Gauge
-	ErroneousRequests prometheus.Counter
+	ErroneousRequests prometheus.Gauge
+	TimedOut          prometheus.Gauge
 	Tasks             []*config.Task
+
+	// Cache is set when CloudWatch is polled in the background, metrics are then served from it
+	Cache *pollCache
+
+	// backfill holds the datapoints older than the latest one of their series, for metrics exporting all their datapoints
+	backfill      []backfillSample
+	backfillMutex sync.Mutex
+
+	// ctx is done once the scrape deadline passed or the client disconnected, outstanding calls are then cancelled
+	ctx context.Context
 }
 
 var tasks []*config.Task
 
-func buildTask(task config.Task) *config.Task {
+// buildTask copies a task for a given account and region and compiles the descriptors of its metrics.
+func buildTask(task config.Task, cfg *config.Settings) (*config.Task, error) {
 	var newTask = new(config.Task)
 
 	// Save the task it belongs to (Perform a deep copy)
@@ -36,106 +48,175 @@ func buildTask(task config.Task) *config.Task {
 	newTask.Name = task.Name
 	newTask.RoleName = task.RoleName
 	newTask.Account = task.Account
+	newTask.PollIntervalSeconds = task.PollIntervalSeconds
+	newTask.Regions = task.Regions
+	newTask.ExcludeRegions = task.ExcludeRegions
+	newTask.RelabelConfigs = task.RelabelConfigs
 
-	for _, metric := range task.Metrics {
-		labels := make([]string, len(metric.Dimensions))
+	// Accounts which aren't in the accounts list, or have no name, are named by their ID
+	metadataLabels := cfg.MetadataLabels()
+	newTask.LabelValues = []string{accountLabel(task.Account)}
+	account := cfg.GetAccount(task.Account)
+	if account != nil && account.Name != "" {
+		newTask.LabelValues[0] = account.Name
+	}
+	for _, name := range metadataLabels {
+		value := ""
+		if account != nil {
+			value = account.Metadata[name]
+		}
+		newTask.LabelValues = append(newTask.LabelValues, value)
+	}
+
+	// Each metric gets its own descriptor so that metrics grouped in a task keep their name and labels
+	for m := range newTask.Metrics {
+		metric := &newTask.Metrics[m]
 
-		for i, dimension := range metric.Dimensions {
-			labels[i] = toSnakeCase(dimension)
+		// Dimensions which have neither a select nor a select regex select everything
+		selectRegex := map[string]string{}
+		for dimension, regex := range metric.DimensionsSelectRegex {
+			selectRegex[dimension] = regex
 		}
-		labels = append(labels, "task")
-		labels = append(labels, "region")
-		labels = append(labels, "account")
-		labels = append(labels, "statistic")
+		for _, dimension := range metric.Dimensions {
+			_, found := metric.DimensionsSelect[dimension]
+			_, found2 := selectRegex[dimension]
+			if !found && !found2 {
+				selectRegex[dimension] = ".*"
+			}
+		}
+		metric.DimensionsSelectRegex = selectRegex
 
-		newTask.Desc = prometheus.NewDesc(
-			safeName(toSnakeCase(fmt.Sprintf("%s_%s", metric.Namespace, metric.Name))),
-			fmt.Sprintf("%s %s", metric.Namespace, metric.Name),
-			labels,
-			nil)
-		newTask.ValType = prometheus.GaugeValue
-		newTask.LabelNames = labels
-	}
+		// Regexes are compiled once here rather than on every scrape, they were checked when the configuration was loaded
+		metric.DimensionsRegexps = map[string]*regexp.Regexp{}
+		for dimension, regex := range selectRegex {
+			metric.DimensionsRegexps[dimension] = regexp.MustCompile(regex)
+		}
 
-	return newTask
-}
+		// Account metadata labels can't replace the dimension and tag labels
+		for _, name := range metadataLabels {
+			if config.Contains(metric.DimensionLabels(), name) {
+				return nil, fmt.Errorf("task %s, metric %s %s: account metadata label %q conflicts with a dimension or tag label", task.Name, metric.Namespace, metric.Name, name)
+			}
+		}
+		labels := metric.GeneratedLabels(metadataLabels)
 
-func getAllRegions() []string {
-	regionList := []string{}
-	session := session.Must(session.NewSession())
-	svc := ec2.New(session, &aws.Config{Region: aws.String("us-east-1")})
-	result, err := svc.DescribeRegions(&ec2.DescribeRegionsInput{})
-	if err != nil {
-		println(err.Error())
-		return regionList
+		// Static labels can't replace the generated ones
+		for name := range metric.Labels {
+			for _, label := range labels {
+				if name == label {
+					return nil, fmt.Errorf("task %s, metric %s %s: static label %q conflicts with a generated label", task.Name, metric.Namespace, metric.Name, name)
+				}
+			}
+		}
+
+		metric.FQNames = map[string]string{}
+		metric.Descs = map[string]*prometheus.Desc{}
+		metric.UnitFactors = map[string]float64{}
+		for _, stat := range append(append([]string{}, metric.Statistics...), metric.ExtendedStatistics...) {
+			statName, statHelp, factor := metric.ExportedStatistic(cfg.MetricPrefix, stat)
+			metric.FQNames[stat] = statName
+			metric.Descs[stat] = prometheus.NewDesc(statName, statHelp, labels, metric.Labels)
+			metric.UnitFactors[stat] = factor
+		}
+
+		// SampleCount is never converted, in label mode it can only share its name with statistics which aren't either
+		if metric.StatisticMode == config.StatisticLabel && config.Contains(metric.Statistics, "SampleCount") {
+			for stat, name := range metric.FQNames {
+				if name != metric.FQNames["SampleCount"] || metric.UnitFactors[stat] != 1 {
+					return nil, fmt.Errorf("task %s, metric %s %s: SampleCount can't share a name with the statistics converted to %s, use statistic_mode suffix or convert_unit false", task.Name, metric.Namespace, metric.Name, metric.Unit)
+				}
+			}
+		}
+		metric.ValType = valueType(metric.PrometheusType)
+		metric.LabelNames = labels
+		metric.Relabel = append(append([]*config.RelabelConfig{}, task.RelabelConfigs...), metric.RelabelConfigs...)
 	}
 
-	for _, region := range result.Regions {
-		regionList = append(regionList, *region.RegionName)
+	// Expressions are exported like a metric with a single statistic, with the labels of the first metric they reference
+	newTask.Expressions = make([]config.Expression, len(task.Expressions))
+	copy(newTask.Expressions, task.Expressions)
+	for e := range newTask.Expressions {
+		expression := &newTask.Expressions[e]
+
+		reference := newTask.GetMetric(expression.References[0])
+		labels := reference.LabelNames
+		if reference.StatisticMode == config.StatisticLabel {
+			labels = labels[:len(labels)-1]
+		}
+
+		name, help := expression.ExportedName(cfg.MetricPrefix)
+
+		expression.Metric = &config.Metric{
+			ID:             expression.ID,
+			Help:           help,
+			DatapointsMode: config.DatapointsLatest,
+			PrometheusType: config.TypeGauge,
+			StatisticMode:  config.StatisticSuffix,
+			FQNames:        map[string]string{"": name},
+			Descs:          map[string]*prometheus.Desc{"": prometheus.NewDesc(name, help, labels, nil)},
+			ValType:        prometheus.GaugeValue,
+			LabelNames:     labels,
+			UnitFactors:    map[string]float64{"": 1},
+			Relabel:        append([]*config.RelabelConfig{}, task.RelabelConfigs...),
+		}
 	}
 
-	return regionList
+	return newTask, nil
 }
 
 // generateTasks creates pre-generated metrics descriptions so that only the metrics are created from them during a scrape.
-func generateTasks(cfg *config.Settings) {
-	tasks = []*config.Task{}
+// The generated tasks are returned so that they only replace the current ones once the whole configuration is loaded.
+func generateTasks(cfg *config.Settings) ([]*config.Task, error) {
+	generated := []*config.Task{}
+
+	// The list of regions is only requested once per reload, and only if a task needs it
+	regions := newRegionResolver(cfg)
 
 	for _, task := range cfg.Tasks {
-		if strings.EqualFold(task.Account, "all") {
-			region := task.Region
-			for _, account := range cfg.Accounts {
+		for _, account := range taskAccounts(task, cfg) {
+			for _, region := range regions.taskRegions(task) {
 				task.Account = account
-				
-				// Exclude the account if it's in exclude_accounts
-				exclude := false
-				for _, excludeAccount := range cfg.ExcludeAccounts {
-					if strings.EqualFold(account, excludeAccount) {
-						exclude = true
-					}
-				}
-				if exclude {
-					continue
-				}
-
-				if strings.EqualFold(region, "all") {
-
-					allRegions := getAllRegions()
+				task.Region = region
 
-					for _, regionToAdd := range allRegions {
-						task.Region = regionToAdd
-
-						newTask := buildTask(task)
-						tasks = append(tasks, newTask)
-					}
-				} else {
-					newTask := buildTask(task)
-					tasks = append(tasks, newTask)
+				newTask, err := buildTask(task, cfg)
+				if err != nil {
+					return nil, err
 				}
+				generated = append(generated, newTask)
 			}
-		} else {
-			if strings.EqualFold(task.Region, "all") {
+		}
+	}
 
-				allRegions := getAllRegions()
+	return generated, nil
+}
 
-				for _, region := range allRegions {
-					task.Region = region
+// taskAccounts returns the accounts a task is scraped in, without the excluded accounts.
+func taskAccounts(task config.Task, cfg *config.Settings) []string {
+	if !strings.EqualFold(task.Account, "all") {
+		return []string{task.Account}
+	}
 
-					newTask := buildTask(task)
-					tasks = append(tasks, newTask)
-				}
-			} else {
-				newTask := buildTask(task)
-				tasks = append(tasks, newTask)
+	accounts := []string{}
+	for _, account := range cfg.Accounts {
+		// Exclude the account if it's in exclude_accounts
+		exclude := false
+		for _, excludeAccount := range cfg.ExcludeAccounts {
+			if strings.EqualFold(account.ID, excludeAccount) {
+				exclude = true
 			}
 		}
+		if !exclude {
+			accounts = append(accounts, account.ID)
+		}
 	}
+	return accounts
 }
 
 // NewCwCollector creates a new instance of a CwCollector for a specific task
 // The newly created instance will reference its parent task so that metric descriptions are not recreated on every call.
+// The context bounds the scrape, the series scraped until it's done are still returned.
 // It returns either a pointer to a new instance of cwCollector or an error.
-func NewCwCollector(target string, taskName string, region string) (*Collector, error) {
+func NewCwCollector(ctx context.Context, target string, taskName string, region string) (*Collector, error) {
 	// Check if task exists
 	_, err := settings.GetTasks(taskName)
 	if err != nil {
@@ -169,26 +250,81 @@ func NewCwCollector(target string, taskName string, region string) (*Collector,
 			Name: "cloudwatch_exporter_erroneous_requests",
 			Help: "The number of erroneous request made by this scrape.",
 		}),
+		TimedOut: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudwatch_exporter_scrape_timed_out",
+			Help: "Whether this scrape was cut short by its deadline or the client disconnecting.",
+		}),
 		Tasks: tasksToUse,
+		Cache: pollingCache,
+		ctx:   ctx,
 	}, nil
 }
 
 // Collect is used by the prometheus library to collect metrics
 func (collector *Collector) Collect(ch chan<- prometheus.Metric) {
 	now := time.Now()
-	scrape(collector, ch)
+	if collector.Cache != nil {
+		collectCached(collector, ch)
+	} else {
+		scrape(collector.ctx, collector, ch)
+	}
 	collector.ScrapeTime.Set(time.Since(now).Seconds())
+	if collector.ctx.Err() != nil {
+		collector.TimedOut.Set(1)
+	}
 
 	ch <- collector.ScrapeTime
 	ch <- collector.ErroneousRequests
+	ch <- collector.TimedOut
+}
+
+// addBackfill buffers a sample which can't be sent through the registry, see backfillGatherer.
+func (collector *Collector) addBackfill(name string, metric prometheus.Metric) {
+	collector.backfillMutex.Lock()
+	collector.backfill = append(collector.backfill, backfillSample{name: name, metric: metric})
+	collector.backfillMutex.Unlock()
+}
+
+// collectCached sends the metrics polled in the background for the tasks of the collector.
+// Tasks relying on $_target are added to the polling set the first time a target is requested.
+func collectCached(collector *Collector, ch chan<- prometheus.Metric) {
+	erroneous := 0.0
+	for _, task := range collector.Tasks {
+		target := ""
+		if usesTarget(task) {
+			target = collector.Target
+		}
+		erroneous += collector.Cache.entry(task, target).collect(collector, ch)
+	}
+	collector.ErroneousRequests.Set(erroneous)
 }
 
 // Describe is used by the prometheus library to create descriptions for metrics
+// When a metric is relabelled, its name and labels are only known once scraped: nothing is described and the collector is left unchecked.
 func (collector *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, task := range collector.Tasks {
+		for _, metric := range task.Metrics {
+			if len(metric.Relabel) > 0 {
+				return
+			}
+		}
+	}
+
 	ch <- collector.ScrapeTime.Desc()
 	ch <- collector.ErroneousRequests.Desc()
+	ch <- collector.TimedOut.Desc()
+	if collector.Cache != nil {
+		ch <- cacheAgeDesc
+	}
 
 	for _, task := range collector.Tasks {
-		ch <- task.Desc
+		for _, metric := range task.Metrics {
+			for _, desc := range metric.Descs {
+				ch <- desc
+			}
+		}
+		for _, expression := range task.Expressions {
+			ch <- expression.Metric.Descs[""]
+		}
 	}
 }
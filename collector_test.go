@@ -0,0 +1,293 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// loadSettings loads a configuration file with the given content.
+func loadSettings(t *testing.T, content string) *config.Settings {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cloudwatch_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return cfg
+}
+
+func TestGenerateTasks(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "metadata labels",
+			config: `
+accounts:
+  - id: "111"
+    metadata: {team: data}
+tasks:
+  - name: ec2
+    region: eu-west-1
+    account: "111"
+    role_name: exporter
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+`,
+		},
+		{
+			name: "metadata label named like a dimension",
+			config: `
+accounts:
+  - id: "111"
+    metadata: {instance_id: i-1}
+tasks:
+  - name: ec2
+    region: eu-west-1
+    account: "111"
+    role_name: exporter
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+`,
+			err: `account metadata label "instance_id" conflicts with a dimension or tag label`,
+		},
+		{
+			name: "metadata label named like a tag",
+			config: `
+accounts:
+  - id: "111"
+    metadata: {tag_team: data}
+tasks:
+  - name: ec2
+    region: eu-west-1
+    account: "111"
+    role_name: exporter
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        aws_tag_select:
+          tag_selections: {env: [prod]}
+          export_tags: [Team]
+`,
+			err: `account metadata label "tag_team" conflicts with a dimension or tag label`,
+		},
+		{
+			name: "static label named like a dimension",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        labels: {instance_id: i-1}
+`,
+			err: `static label "instance_id" conflicts with a generated label`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := generateTasks(loadSettings(t, test.config))
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestGenerateTasksNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		names      map[string]string
+		factors    map[string]float64
+		expression string
+		err        string
+	}{
+		{
+			name: "metric prefix",
+			config: `
+metric_prefix: cw_
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - id: cpu
+        aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_statistics: [Average]
+    expressions:
+      - id: cpu_ratio
+        expression: cpu / 100
+`,
+			names:      map[string]string{"Average": "cw_aws_ec2_cpu_utilization"},
+			factors:    map[string]float64{"Average": 1},
+			expression: "cw_cpu_ratio",
+		},
+		{
+			name: "explicit names without the metric prefix",
+			config: `
+metric_prefix: cw_
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - id: cpu
+        aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_statistics: [Average]
+        aws_unit: Percent
+        prometheus_name: ec2_cpu
+        statistic_mode: suffix
+    expressions:
+      - id: cpu_ratio
+        expression: cpu / 100
+        name: ec2_cpu_ratio
+`,
+			names:      map[string]string{"Average": "ec2_cpu_ratio_average"},
+			factors:    map[string]float64{"Average": 1e-2},
+			expression: "ec2_cpu_ratio",
+		},
+		{
+			name: "suffix mode",
+			config: `
+tasks:
+  - name: elb
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/ELB
+        aws_metric_name: Latency
+        aws_statistics: [Average, SampleCount]
+        aws_extended_statistics: [p99]
+        aws_unit: Milliseconds
+        statistic_mode: suffix
+`,
+			names: map[string]string{
+				"Average":     "aws_elb_latency_seconds_average",
+				"SampleCount": "aws_elb_latency_sample_count",
+				"p99":         "aws_elb_latency_seconds_p99",
+			},
+			factors: map[string]float64{"Average": 1e-3, "SampleCount": 1, "p99": 1e-3},
+		},
+		{
+			name: "label mode without conversion",
+			config: `
+tasks:
+  - name: elb
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/ELB
+        aws_metric_name: Latency
+        aws_statistics: [Average, SampleCount]
+        aws_unit: Milliseconds
+        convert_unit: false
+`,
+			names:   map[string]string{"Average": "aws_elb_latency", "SampleCount": "aws_elb_latency"},
+			factors: map[string]float64{"Average": 1, "SampleCount": 1},
+		},
+		{
+			name: "label mode with a count unit",
+			config: `
+tasks:
+  - name: lambda
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/Lambda
+        aws_metric_name: Errors
+        aws_statistics: [Sum, SampleCount]
+        aws_unit: Count
+`,
+			names:   map[string]string{"Sum": "aws_lambda_errors", "SampleCount": "aws_lambda_errors"},
+			factors: map[string]float64{"Sum": 1, "SampleCount": 1},
+		},
+		{
+			name: "label mode with SampleCount alone",
+			config: `
+tasks:
+  - name: elb
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/ELB
+        aws_metric_name: Latency
+        aws_statistics: [SampleCount]
+        aws_unit: Milliseconds
+`,
+			names:   map[string]string{"SampleCount": "aws_elb_latency"},
+			factors: map[string]float64{"SampleCount": 1},
+		},
+		{
+			name: "label mode with conversion",
+			config: `
+tasks:
+  - name: elb
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/ELB
+        aws_metric_name: Latency
+        aws_statistics: [Average, SampleCount]
+        aws_unit: Milliseconds
+`,
+			err: "SampleCount can't share a name with the statistics converted to Milliseconds",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tasks, err := generateTasks(loadSettings(t, test.config))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			metric := tasks[0].Metrics[0]
+			if !reflect.DeepEqual(metric.FQNames, test.names) {
+				t.Errorf("expected names %v, got %v", test.names, metric.FQNames)
+			}
+			if !reflect.DeepEqual(metric.UnitFactors, test.factors) {
+				t.Errorf("expected factors %v, got %v", test.factors, metric.UnitFactors)
+			}
+			if test.expression != "" {
+				if name := tasks[0].Expressions[0].Metric.FQNames[""]; name != test.expression {
+					t.Errorf("expected expression name %s, got %s", test.expression, name)
+				}
+			}
+		})
+	}
+}
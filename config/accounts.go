@@ -0,0 +1,52 @@
+package config
+
+import (
+	"sort"
+)
+
+// Account is an AWS account scraped by the tasks set to all accounts.
+// In the settings file it's either the account ID alone, or an object with a name and metadata labels.
+type Account struct {
+	ID       string            `yaml:"id"`
+	Name     string            `yaml:"name,omitempty"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+}
+
+// UnmarshalYAML accepts both a plain account ID and an account object.
+func (account *Account) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var id string
+	if err := unmarshal(&id); err == nil {
+		*account = Account{ID: id}
+		return nil
+	}
+
+	type plain Account
+	return unmarshal((*plain)(account))
+}
+
+// GetAccount returns the account with the given ID, or nil if it isn't in the accounts list.
+func (settings *Settings) GetAccount(id string) *Account {
+	for i := range settings.Accounts {
+		if settings.Accounts[i].ID == id {
+			return &settings.Accounts[i]
+		}
+	}
+	return nil
+}
+
+// MetadataLabels returns the sorted names of the metadata labels of all the accounts.
+// Every series carries all of them so that series of different accounts share the same label names.
+func (settings *Settings) MetadataLabels() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, account := range settings.Accounts {
+		for name := range account.Metadata {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"regexp"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
@@ -11,6 +12,7 @@ import (
 
 // Metric is the smallest unit of scraping. It represents metrics from a single namespace in Cloudwatch Metrics.
 type Metric struct {
+	ID        string `yaml:"id,omitempty"`
 	Namespace string `yaml:"aws_namespace"`
 	Name      string `yaml:"aws_metric_name"`
 
@@ -19,34 +21,96 @@ type Metric struct {
 	Dimensions            []string            `yaml:"aws_dimensions,omitempty"`
 	DimensionsSelect      map[string][]string `yaml:"aws_dimensions_select,omitempty"`
 	DimensionsSelectRegex map[string]string   `yaml:"aws_dimensions_select_regex,omitempty"`
+	RecentlyActive        string              `yaml:"recently_active,omitempty"`
+	Search                bool                `yaml:"aws_search,omitempty"`
+	Unit                  string              `yaml:"aws_unit,omitempty"`
+	TagSelect             *TagSelect          `yaml:"aws_tag_select,omitempty"`
 
 	RangeSeconds  int `yaml:"range_seconds,omitempty"`
 	PeriodSeconds int `yaml:"period_seconds,omitempty"`
 	DelaySeconds  int `yaml:"delay_seconds,omitempty"`
+
+	PrometheusName string            `yaml:"prometheus_name,omitempty"`
+	Help           string            `yaml:"help,omitempty"`
+	Labels         map[string]string `yaml:"labels,omitempty"`
+
+	SetTimestamp   *bool  `yaml:"set_timestamp,omitempty"`
+	DatapointsMode string `yaml:"datapoints_mode,omitempty"`
+	StatisticMode  string `yaml:"statistic_mode,omitempty"`
+	PrometheusType string `yaml:"prometheus_type,omitempty"`
+	ConvertUnit    *bool  `yaml:"convert_unit,omitempty"`
+
+	RelabelConfigs []*RelabelConfig `yaml:"relabel_configs,omitempty"`
+
+	// These fields are determined at runtime
+	// FQNames and Descs hold the name and descriptor of each statistic
+	// UnitFactors hold the factor converting the values of each statistic to the base unit of the metric
+	FQNames           map[string]string           `yaml:"-"`
+	Descs             map[string]*prometheus.Desc `yaml:"-"`
+	ValType           prometheus.ValueType        `yaml:"-"`
+	LabelNames        []string                    `yaml:"-"`
+	UnitFactors       map[string]float64          `yaml:"-"`
+	DimensionsRegexps map[string]*regexp.Regexp   `yaml:"-"`
+	// Relabel holds the relabel configs of the task followed by the ones of the metric
+	Relabel []*RelabelConfig `yaml:"-"`
 }
 
 // Task represents a single task. A task is confined to a single region and a single account.
 type Task struct {
 	// These fields come from the config file
-	Name     string   `yaml:"name"`
-	Region   string   `yaml:"region,omitempty"`
-	Metrics  []Metric `yaml:"metrics"`
-	RoleName string   `yaml:"role_name,omitempty"`
-	Account  string   `yaml:"account,omitempty"`
+	Name           string   `yaml:"name"`
+	Region         string   `yaml:"region,omitempty"`
+	Regions        []string `yaml:"regions,omitempty"`
+	ExcludeRegions []string `yaml:"exclude_regions,omitempty"`
+	Metrics        []Metric `yaml:"metrics"`
+	RoleName       string   `yaml:"role_name,omitempty"`
+	Account        string   `yaml:"account,omitempty"`
+
+	PollIntervalSeconds int              `yaml:"poll_interval_seconds,omitempty"`
+	RelabelConfigs      []*RelabelConfig `yaml:"relabel_configs,omitempty"`
+	Expressions         []Expression     `yaml:"expressions,omitempty"`
 
 	// These fields are determined at runtime
-	Desc        *prometheus.Desc
-	ValType     prometheus.ValueType
-	LabelNames  []string
-	LabelValues []string
+	// LabelValues holds the values of the account_name and account metadata labels
+	LabelValues []string `yaml:"-"`
+}
+
+// AccountsDiscovery lists the accounts to scrape from AWS Organizations instead of a static list.
+type AccountsDiscovery struct {
+	// Role to assume in the management account, the default credential chain is used if not set
+	Account  string `yaml:"account,omitempty"`
+	RoleName string `yaml:"role_name,omitempty"`
+
+	OrganizationalUnits    []string          `yaml:"organizational_units,omitempty"`
+	Tags                   map[string]string `yaml:"tags,omitempty"`
+	Status                 string            `yaml:"status,omitempty"`
+	RefreshIntervalSeconds int               `yaml:"refresh_interval_seconds,omitempty"`
+
+	// Endpoint overrides the Organizations API endpoint, for example to use a local fake
+	Endpoint string `yaml:"endpoint,omitempty"`
 }
 
 // Settings is a top level struct representing the settings file.
 // It divides what is scraped into several "tasks".
 type Settings struct {
-	Accounts        []string `yaml:"accounts,omitempty"`
-	ExcludeAccounts []string `yaml:"exclude_accounts,omitempty"`
-	Tasks           []Task   `yaml:"tasks"`
+	MetricPrefix      string             `yaml:"metric_prefix,omitempty"`
+	StatisticMode     string             `yaml:"statistic_mode,omitempty"`
+	Accounts          []Account          `yaml:"accounts,omitempty"`
+	AccountsDiscovery *AccountsDiscovery `yaml:"accounts_discovery,omitempty"`
+	ExcludeAccounts   []string           `yaml:"exclude_accounts,omitempty"`
+	ExcludeRegions    []string           `yaml:"exclude_regions,omitempty"`
+	Retry             *RetryPolicy       `yaml:"retry,omitempty"`
+	Tasks             []Task             `yaml:"tasks"`
+}
+
+// GetMetric returns the metric of the task with the given id, or nil if there's none.
+func (task *Task) GetMetric(id string) *Metric {
+	for i := range task.Metrics {
+		if task.Metrics[i].ID == id {
+			return &task.Metrics[i]
+		}
+	}
+	return nil
 }
 
 // GetTasks returns all tasks with a given name
@@ -57,6 +121,8 @@ func (settings *Settings) GetTasks(name string) ([]*Task, error) {
 			// Add the task to the list (with a deep copy)
 			newTask := new(Task)
 			newTask.Region = task.Region
+			newTask.Regions = task.Regions
+			newTask.ExcludeRegions = task.ExcludeRegions
 			newTask.Metrics = *new([]Metric)
 			for _, metric := range task.Metrics {
 				newTask.Metrics = append(newTask.Metrics, metric)
@@ -64,6 +130,9 @@ func (settings *Settings) GetTasks(name string) ([]*Task, error) {
 			newTask.Name = task.Name
 			newTask.Account = task.Account
 			newTask.RoleName = task.RoleName
+			newTask.PollIntervalSeconds = task.PollIntervalSeconds
+			newTask.RelabelConfigs = task.RelabelConfigs
+			newTask.Expressions = task.Expressions
 			taskList = append(taskList, newTask)
 		}
 	}
@@ -74,7 +143,8 @@ func (settings *Settings) GetTasks(name string) ([]*Task, error) {
 	return nil, fmt.Errorf("can't find task '%s' in configuration", name)
 }
 
-// Load returns a settings struct loaded from a given file
+// Load returns a settings struct loaded from a given file.
+// Documented defaults are applied and the settings are validated before being returned.
 func Load(filename string) (*Settings, error) {
 	log.SetFlags(log.Lshortfile)
 	content, err := ioutil.ReadFile(filename)
@@ -88,5 +158,11 @@ func Load(filename string) (*Settings, error) {
 		return nil, err
 	}
 
+	cfg.setDefaults()
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"regexp"
+)
+
+var (
+	// idRegex matches the ids CloudWatch accepts for the queries of a GetMetricData call
+	idRegex = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]*$`)
+	// expressionTokenRegex matches the quoted strings and identifiers of an expression, quoted strings are never replaced
+	expressionTokenRegex = regexp.MustCompile(`'[^']*'|"[^"]*"|[a-zA-Z_][a-zA-Z0-9_]*`)
+)
+
+// Expression is a CloudWatch metric math expression combining the metrics of a task, exported as its own metric.
+type Expression struct {
+	ID         string `yaml:"id"`
+	Expression string `yaml:"expression"`
+	Name       string `yaml:"name,omitempty"`
+	Help       string `yaml:"help,omitempty"`
+
+	// These fields are determined at runtime
+	// References holds the ids of the metrics used by the expression
+	References []string `yaml:"-"`
+	// Metric describes how the series of the expression are exported
+	Metric *Metric `yaml:"-"`
+}
+
+// tokens returns the identifiers used by the expression, without the ones in quoted strings.
+func (expression *Expression) tokens() []string {
+	var tokens []string
+	for _, token := range expressionTokenRegex.FindAllString(expression.Expression, -1) {
+		if token[0] != '\'' && token[0] != '"' {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Rewrite returns the expression with the ids of its metrics replaced by the given ones.
+func (expression *Expression) Rewrite(ids map[string]string) string {
+	return expressionTokenRegex.ReplaceAllStringFunc(expression.Expression, func(token string) string {
+		if id, ok := ids[token]; ok {
+			return id
+		}
+		return token
+	})
+}
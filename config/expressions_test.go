@@ -0,0 +1,48 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpressionTokens(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   []string
+	}{
+		{expression: "errors / invocations * 100", expected: []string{"errors", "invocations"}},
+		{expression: "errors_5xx+errors_4xx", expected: []string{"errors_5xx", "errors_4xx"}},
+		{expression: "FILL(errors, 0)", expected: []string{"FILL", "errors"}},
+		{expression: `SEARCH('{AWS/Lambda} errors', 'Sum', 60) + "invocations"`, expected: []string{"SEARCH"}},
+		{expression: "100", expected: nil},
+	}
+
+	for _, test := range tests {
+		expression := &Expression{Expression: test.expression}
+		if tokens := expression.tokens(); !reflect.DeepEqual(tokens, test.expected) {
+			t.Errorf("%s: expected tokens %v, got %v", test.expression, test.expected, tokens)
+		}
+	}
+}
+
+func TestExpressionRewrite(t *testing.T) {
+	ids := map[string]string{"errors": "q0", "invocations": "q1"}
+
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{expression: "errors / invocations * 100", expected: "q0 / q1 * 100"},
+		{expression: "errors/(invocations+errors)", expected: "q0/(q1+q0)"},
+		{expression: "FILL(errors, 0)", expected: "FILL(q0, 0)"},
+		{expression: "errors_total + errors", expected: "errors_total + q0"},
+		{expression: `SEARCH('{AWS/Lambda} errors', 'Sum', 60) + errors`, expected: `SEARCH('{AWS/Lambda} errors', 'Sum', 60) + q0`},
+	}
+
+	for _, test := range tests {
+		expression := &Expression{Expression: test.expression}
+		if rewritten := expression.Rewrite(ids); rewritten != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.expression, test.expected, rewritten)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	sanitizeNameRegex, _ = regexp.Compile("[^a-zA-Z0-9:_]")
+	mergeUScoreRegex, _  = regexp.Compile("__+")
+)
+
+// SafeName lowercases a name and replaces the characters Prometheus doesn't accept in metric names with underscores.
+func SafeName(dirty string) string {
+	return mergeUScoreRegex.ReplaceAllString(
+		sanitizeNameRegex.ReplaceAllString(
+			strings.ToLower(dirty), "_"),
+		"_")
+}
+
+// ToSnakeCase converts a CamelCase name, such as a CloudWatch metric or dimension name, to snake_case.
+func ToSnakeCase(in string) string {
+	runes := []rune(in)
+	length := len(runes)
+
+	var out []rune
+	for i := 0; i < length; i++ {
+		if i > 0 && unicode.IsUpper(runes[i]) && ((i+1 < length && unicode.IsLower(runes[i+1])) || unicode.IsLower(runes[i-1])) {
+			out = append(out, '_')
+		}
+		out = append(out, unicode.ToLower(runes[i]))
+	}
+
+	return string(out)
+}
+
+// ExportedStatistic returns the name and help a statistic of the metric is exported with, and the factor converting its values.
+// Explicit names are used as they are, without the metric prefix.
+// The base unit goes before the statistic, like the _sum and _count of Prometheus histograms.
+// SampleCount counts datapoints, so it keeps neither the unit nor its factor.
+func (metric *Metric) ExportedStatistic(prefix string, stat string) (string, string, float64) {
+	name := prefix + SafeName(ToSnakeCase(fmt.Sprintf("%s_%s", metric.Namespace, metric.Name)))
+	if len(metric.PrometheusName) > 0 {
+		name = metric.PrometheusName
+	}
+	help := fmt.Sprintf("%s %s", metric.Namespace, metric.Name)
+	if len(metric.Help) > 0 {
+		help = metric.Help
+	}
+
+	factor := 1.0
+	if stat != "SampleCount" {
+		name = metric.unitName(name)
+		factor = metric.unitFactor()
+	}
+
+	// In suffix mode, each statistic is exported under its own name, such as aws_lambda_errors_sum or aws_ec2_cpu_utilization_p99
+	if metric.StatisticMode == StatisticSuffix {
+		name = name + "_" + SafeName(ToSnakeCase(stat))
+		if len(metric.Help) == 0 {
+			help = fmt.Sprintf("%s %s", help, stat)
+		}
+	}
+	return name, help, factor
+}
+
+// DimensionLabels returns the names of the labels holding the dimensions and exported tags of the metric.
+func (metric *Metric) DimensionLabels() []string {
+	labels := make([]string, len(metric.Dimensions))
+	for i, dimension := range metric.Dimensions {
+		labels[i] = ToSnakeCase(dimension)
+	}
+	if metric.TagSelect != nil {
+		for _, tag := range metric.TagSelect.ExportTags {
+			labels = append(labels, "tag_"+SafeName(ToSnakeCase(tag)))
+		}
+	}
+	return labels
+}
+
+// GeneratedLabels returns the names of the labels the exporter sets on the series of the metric, in the order of their values.
+func (metric *Metric) GeneratedLabels(metadataLabels []string) []string {
+	labels := append(metric.DimensionLabels(), "task", "region", "account", "account_name")
+	labels = append(labels, metadataLabels...)
+	if metric.StatisticMode == StatisticLabel {
+		labels = append(labels, "statistic")
+	}
+	return labels
+}
+
+// ExportedName returns the name and help the expression is exported with.
+// Explicit names are used as they are, without the metric prefix.
+func (expression *Expression) ExportedName(prefix string) (string, string) {
+	name := prefix + SafeName(ToSnakeCase(expression.ID))
+	if len(expression.Name) > 0 {
+		name = expression.Name
+	}
+	help := expression.Expression
+	if len(expression.Help) > 0 {
+		help = expression.Help
+	}
+	return name, help
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Relabel actions, with the same meaning as in Prometheus relabel_configs
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelHashMod   = "hashmod"
+)
+
+// DefaultRelabelConfig holds the values of the fields a relabel config doesn't set.
+var DefaultRelabelConfig = RelabelConfig{
+	Separator:   ";",
+	Regex:       "(.*)",
+	Replacement: "$1",
+	Action:      RelabelReplace,
+}
+
+// RelabelConfig is a Prometheus-style relabelling rule applied to every series before it's exported.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+
+	// This field is determined at load time, the regex is anchored like in Prometheus
+	Regexp *regexp.Regexp `yaml:"-"`
+}
+
+// UnmarshalYAML applies the default values before reading the rule, so that an explicitly empty replacement is kept.
+func (relabel *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*relabel = DefaultRelabelConfig
+	type plain RelabelConfig
+	return unmarshal((*plain)(relabel))
+}
+
+// compile checks the rule and compiles its regex. It returns the problems found.
+func (relabel *RelabelConfig) compile() []string {
+	var errs []string
+
+	regex, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", relabel.Regex))
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("invalid regex %q: %s", relabel.Regex, err))
+	}
+	relabel.Regexp = regex
+
+	switch relabel.Action {
+	case RelabelReplace:
+		if relabel.TargetLabel == "" {
+			errs = append(errs, "target_label is required for the replace action")
+		}
+	case RelabelHashMod:
+		if relabel.TargetLabel == "" {
+			errs = append(errs, "target_label is required for the hashmod action")
+		}
+		if relabel.Modulus == 0 {
+			errs = append(errs, "modulus is required for the hashmod action")
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(relabel.SourceLabels) == 0 {
+			errs = append(errs, fmt.Sprintf("source_labels are required for the %s action", relabel.Action))
+		}
+	case RelabelLabelMap, RelabelLabelDrop:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown action %q", relabel.Action))
+	}
+
+	return errs
+}
@@ -0,0 +1,48 @@
+package config
+
+const (
+	// DefaultMaxAttempts is the number of attempts of an API call when max_attempts isn't set
+	DefaultMaxAttempts = 3
+	// DefaultBaseDelaySeconds is the delay before the first retry when base_delay_seconds isn't set
+	DefaultBaseDelaySeconds = 0.1
+	// DefaultThrottleDelaySeconds is the delay before the first retry of a throttled call when throttle_delay_seconds isn't set
+	DefaultThrottleDelaySeconds = 1
+	// DefaultMaxDelaySeconds is the longest delay between two attempts when max_delay_seconds isn't set
+	DefaultMaxDelaySeconds = 20
+)
+
+// RetryPolicy decides how the failed calls to AWS APIs are retried.
+// The delay doubles with every attempt, up to the maximum delay, and a random jitter of up to half the delay is removed.
+type RetryPolicy struct {
+	MaxAttempts          int     `yaml:"max_attempts,omitempty"`
+	BaseDelaySeconds     float64 `yaml:"base_delay_seconds,omitempty"`
+	ThrottleDelaySeconds float64 `yaml:"throttle_delay_seconds,omitempty"`
+	MaxDelaySeconds      float64 `yaml:"max_delay_seconds,omitempty"`
+
+	// RetryCodes are always retried and NoRetryCodes never are, other errors are retried if the SDK considers them transient
+	RetryCodes   []string `yaml:"retry_codes,omitempty"`
+	NoRetryCodes []string `yaml:"no_retry_codes,omitempty"`
+}
+
+// setDefaults fills the fields which aren't set.
+func (policy *RetryPolicy) setDefaults() {
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = DefaultMaxAttempts
+	}
+	if policy.BaseDelaySeconds == 0 {
+		policy.BaseDelaySeconds = DefaultBaseDelaySeconds
+	}
+	if policy.ThrottleDelaySeconds == 0 {
+		policy.ThrottleDelaySeconds = DefaultThrottleDelaySeconds
+	}
+	if policy.MaxDelaySeconds == 0 {
+		policy.MaxDelaySeconds = DefaultMaxDelaySeconds
+	}
+}
+
+// DefaultRetryPolicy returns the policy used when the settings don't set one.
+func DefaultRetryPolicy() *RetryPolicy {
+	policy := &RetryPolicy{}
+	policy.setDefaults()
+	return policy
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TagSelect selects the resources of a metric by their tags, through the Resource Groups Tagging API.
+type TagSelect struct {
+	TagSelections         map[string][]string `yaml:"tag_selections"`
+	ResourceTypeSelection string              `yaml:"resource_type_selection,omitempty"`
+	ResourceIDDimension   string              `yaml:"resource_id_dimension,omitempty"`
+	ExportTags            []string            `yaml:"export_tags,omitempty"`
+}
+
+// TaggedNamespace describes how the tagged resources of a namespace map to the dimension identifying them.
+type TaggedNamespace struct {
+	ResourceType string
+	Dimension    string
+	// ARNRegex captures the value of the dimension from the ARN of a resource
+	ARNRegex *regexp.Regexp
+}
+
+// TaggedNamespaces is the built-in mapping of namespaces to their tagged resources.
+var TaggedNamespaces = map[string]TaggedNamespace{
+	"AWS/ApplicationELB": {"elasticloadbalancing:loadbalancer", "LoadBalancer", regexp.MustCompile(`:loadbalancer/(app/.+)$`)},
+	"AWS/DynamoDB":       {"dynamodb:table", "TableName", regexp.MustCompile(`:table/([^/]+)$`)},
+	"AWS/EC2":            {"ec2:instance", "InstanceId", regexp.MustCompile(`:instance/(.+)$`)},
+	"AWS/ECS":            {"ecs:cluster", "ClusterName", regexp.MustCompile(`:cluster/(.+)$`)},
+	"AWS/ELB":            {"elasticloadbalancing:loadbalancer", "LoadBalancerName", regexp.MustCompile(`:loadbalancer/([^/]+)$`)},
+	"AWS/ElastiCache":    {"elasticache:cluster", "CacheClusterId", regexp.MustCompile(`:cluster:(.+)$`)},
+	"AWS/Kinesis":        {"kinesis:stream", "StreamName", regexp.MustCompile(`:stream/(.+)$`)},
+	"AWS/Lambda":         {"lambda:function", "FunctionName", regexp.MustCompile(`:function:([^:]+)$`)},
+	"AWS/NetworkELB":     {"elasticloadbalancing:loadbalancer", "LoadBalancer", regexp.MustCompile(`:loadbalancer/(net/.+)$`)},
+	"AWS/RDS":            {"rds:db", "DBInstanceIdentifier", regexp.MustCompile(`:db:(.+)$`)},
+	"AWS/S3":             {"s3", "BucketName", regexp.MustCompile(`:::(.+)$`)},
+	"AWS/SNS":            {"sns", "TopicName", regexp.MustCompile(`:([^:]+)$`)},
+	"AWS/SQS":            {"sqs", "QueueName", regexp.MustCompile(`:([^:]+)$`)},
+}
+
+// setDefaults fills the resource type and dimension from the built-in mapping of the namespace.
+func (tagSelect *TagSelect) setDefaults(namespace string) {
+	tagged, ok := TaggedNamespaces[namespace]
+	if !ok {
+		return
+	}
+	if tagSelect.ResourceTypeSelection == "" {
+		tagSelect.ResourceTypeSelection = tagged.ResourceType
+	}
+	if tagSelect.ResourceIDDimension == "" {
+		tagSelect.ResourceIDDimension = tagged.Dimension
+	}
+}
+
+// ResourceID returns the value of the resource dimension for the ARN of a resource in the given namespace.
+// Namespaces without a built-in mapping, or using another dimension, use the last part of the ARN.
+func (tagSelect *TagSelect) ResourceID(namespace string, arn string) string {
+	tagged, ok := TaggedNamespaces[namespace]
+	if ok && tagged.Dimension == tagSelect.ResourceIDDimension {
+		if match := tagged.ARNRegex.FindStringSubmatch(arn); match != nil {
+			return match[1]
+		}
+	}
+
+	return arn[strings.LastIndexAny(arn, ":/")+1:]
+}
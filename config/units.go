@@ -0,0 +1,81 @@
+package config
+
+import (
+	"strings"
+)
+
+// DefaultConvertUnits decides if the metrics setting aws_unit without convert_unit are converted to base units.
+// It's set from the command line.
+var DefaultConvertUnits = true
+
+// baseUnit is how the values of a CloudWatch unit are converted to a Prometheus base unit.
+type baseUnit struct {
+	factor float64
+	// suffix is appended to the metric name, it's empty for units without a base unit such as Count
+	suffix string
+}
+
+// baseUnits maps the CloudWatch units to Prometheus base units.
+// Bytes use 1024-based multiples and bits 1000-based ones, like CloudWatch.
+var baseUnits = map[string]baseUnit{
+	"Seconds":          {1, "seconds"},
+	"Milliseconds":     {1e-3, "seconds"},
+	"Microseconds":     {1e-6, "seconds"},
+	"Bytes":            {1, "bytes"},
+	"Kilobytes":        {1 << 10, "bytes"},
+	"Megabytes":        {1 << 20, "bytes"},
+	"Gigabytes":        {1 << 30, "bytes"},
+	"Terabytes":        {1 << 40, "bytes"},
+	"Bits":             {1, "bits"},
+	"Kilobits":         {1e3, "bits"},
+	"Megabits":         {1e6, "bits"},
+	"Gigabits":         {1e9, "bits"},
+	"Terabits":         {1e12, "bits"},
+	"Percent":          {1e-2, "ratio"},
+	"Count":            {1, ""},
+	"None":             {1, ""},
+	"Bytes/Second":     {1, "bytes_per_second"},
+	"Kilobytes/Second": {1 << 10, "bytes_per_second"},
+	"Megabytes/Second": {1 << 20, "bytes_per_second"},
+	"Gigabytes/Second": {1 << 30, "bytes_per_second"},
+	"Terabytes/Second": {1 << 40, "bytes_per_second"},
+	"Bits/Second":      {1, "bits_per_second"},
+	"Kilobits/Second":  {1e3, "bits_per_second"},
+	"Megabits/Second":  {1e6, "bits_per_second"},
+	"Gigabits/Second":  {1e9, "bits_per_second"},
+	"Terabits/Second":  {1e12, "bits_per_second"},
+	"Count/Second":     {1, "per_second"},
+}
+
+// convertUnit returns true if the values of the metric are converted to their base unit.
+// Metrics which don't set convert_unit use the exporter-wide default.
+func (metric *Metric) convertUnit() bool {
+	if metric.Unit == "" {
+		return false
+	}
+	if metric.ConvertUnit != nil {
+		return *metric.ConvertUnit
+	}
+	return DefaultConvertUnits
+}
+
+// unitName appends the base unit of the metric to its name, unless the name already ends with it.
+func (metric *Metric) unitName(name string) string {
+	if !metric.convertUnit() {
+		return name
+	}
+
+	suffix := baseUnits[metric.Unit].suffix
+	if suffix == "" || strings.HasSuffix(name, "_"+suffix) {
+		return name
+	}
+	return name + "_" + suffix
+}
+
+// unitFactor returns the factor converting the values of the metric to its base unit.
+func (metric *Metric) unitFactor() float64 {
+	if !metric.convertUnit() {
+		return 1
+	}
+	return baseUnits[metric.Unit].factor
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestUnitName(t *testing.T) {
+	disabled := false
+
+	tests := []struct {
+		name     string
+		metric   Metric
+		expected string
+	}{
+		{name: "aws_elb_latency", metric: Metric{}, expected: "aws_elb_latency"},
+		{name: "aws_elb_latency", metric: Metric{Unit: "Milliseconds"}, expected: "aws_elb_latency_seconds"},
+		{name: "aws_elb_latency_seconds", metric: Metric{Unit: "Seconds"}, expected: "aws_elb_latency_seconds"},
+		{name: "aws_ec2_network_in", metric: Metric{Unit: "Megabytes"}, expected: "aws_ec2_network_in_bytes"},
+		{name: "aws_ec2_cpu_utilization", metric: Metric{Unit: "Percent"}, expected: "aws_ec2_cpu_utilization_ratio"},
+		{name: "aws_kinesis_incoming", metric: Metric{Unit: "Kilobits/Second"}, expected: "aws_kinesis_incoming_bits_per_second"},
+		{name: "aws_lambda_errors", metric: Metric{Unit: "Count"}, expected: "aws_lambda_errors"},
+		{name: "aws_elb_latency", metric: Metric{Unit: "Milliseconds", ConvertUnit: &disabled}, expected: "aws_elb_latency"},
+	}
+
+	for _, test := range tests {
+		if name := test.metric.unitName(test.name); name != test.expected {
+			t.Errorf("%s with unit %q: expected %s, got %s", test.name, test.metric.Unit, test.expected, name)
+		}
+	}
+}
+
+func TestUnitFactor(t *testing.T) {
+	disabled := false
+
+	tests := []struct {
+		metric   Metric
+		expected float64
+	}{
+		{metric: Metric{}, expected: 1},
+		{metric: Metric{Unit: "Microseconds"}, expected: 1e-6},
+		{metric: Metric{Unit: "Kilobytes"}, expected: 1024},
+		{metric: Metric{Unit: "Gigabits"}, expected: 1e9},
+		{metric: Metric{Unit: "Percent"}, expected: 0.01},
+		{metric: Metric{Unit: "Count/Second"}, expected: 1},
+		{metric: Metric{Unit: "Milliseconds", ConvertUnit: &disabled}, expected: 1},
+	}
+
+	for _, test := range tests {
+		if factor := test.metric.unitFactor(); factor != test.expected {
+			t.Errorf("unit %q: expected %g, got %g", test.metric.Unit, test.expected, factor)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultRangeSeconds is the length of the metric window when range_seconds isn't set
+	DefaultRangeSeconds = 600
+	// DefaultPeriodSeconds is the metric period when period_seconds isn't set
+	DefaultPeriodSeconds = 60
+	// DefaultDiscoveryRefreshSeconds is the interval between two account discoveries when refresh_interval_seconds isn't set
+	DefaultDiscoveryRefreshSeconds = 3600
+)
+
+// Datapoints modes decide what is exported from the datapoints of a metric window
+const (
+	// DatapointsLatest exports the newest datapoint
+	DatapointsLatest = "latest"
+	// DatapointsAll exports every datapoint, each with its own timestamp
+	DatapointsAll = "all"
+	// DatapointsMax, DatapointsMin, DatapointsSum and DatapointsAvg reduce the window to a single value
+	DatapointsMax = "max"
+	DatapointsMin = "min"
+	DatapointsSum = "sum"
+	DatapointsAvg = "avg"
+)
+
+// Statistic modes decide how the statistics of a metric are told apart
+const (
+	// StatisticLabel exports every statistic under the same name, with a statistic label
+	StatisticLabel = "label"
+	// StatisticSuffix exports every statistic under its own name, suffixed with the statistic
+	StatisticSuffix = "suffix"
+)
+
+// Prometheus types decide the type the samples of a metric are exported with
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+	TypeUntyped = "untyped"
+	// TypeCumulative adds up the Sum datapoints of a metric into a counter kept by the exporter
+	TypeCumulative = "cumulative"
+)
+
+var (
+	validPrometheusTypes = map[string]bool{
+		TypeGauge:      true,
+		TypeCounter:    true,
+		TypeUntyped:    true,
+		TypeCumulative: true,
+	}
+	validDatapointsModes = map[string]bool{
+		DatapointsLatest: true,
+		DatapointsAll:    true,
+		DatapointsMax:    true,
+		DatapointsMin:    true,
+		DatapointsSum:    true,
+		DatapointsAvg:    true,
+	}
+	validStatistics = map[string]bool{
+		"SampleCount": true,
+		"Average":     true,
+		"Sum":         true,
+		"Minimum":     true,
+		"Maximum":     true,
+	}
+	extendedStatisticRegex = regexp.MustCompile(`^p(\d{1,2}(\.\d+)?|100)$`)
+
+	// reservedLabels are added to every series by the exporter
+	reservedLabels = map[string]bool{
+		"task":         true,
+		"region":       true,
+		"account":      true,
+		"account_name": true,
+		"statistic":    true,
+	}
+)
+
+// MetricNameRegex and LabelNameRegex match the metric and label names Prometheus accepts
+var (
+	MetricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	LabelNameRegex  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// ValidationError holds every problem found in a settings file.
+type ValidationError struct {
+	Errors []string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(err.Errors, "\n  "))
+}
+
+// setDefaults fills the fields which have a documented default value.
+func (settings *Settings) setDefaults() {
+	if settings.AccountsDiscovery != nil && settings.AccountsDiscovery.RefreshIntervalSeconds == 0 {
+		settings.AccountsDiscovery.RefreshIntervalSeconds = DefaultDiscoveryRefreshSeconds
+	}
+
+	if settings.Retry == nil {
+		settings.Retry = &RetryPolicy{}
+	}
+	settings.Retry.setDefaults()
+
+	if settings.StatisticMode == "" {
+		settings.StatisticMode = StatisticLabel
+	}
+
+	for t := range settings.Tasks {
+		for m := range settings.Tasks[t].Metrics {
+			metric := &settings.Tasks[t].Metrics[m]
+			if metric.RangeSeconds == 0 {
+				metric.RangeSeconds = DefaultRangeSeconds
+			}
+			if metric.PeriodSeconds == 0 {
+				metric.PeriodSeconds = DefaultPeriodSeconds
+			}
+			if metric.DatapointsMode == "" {
+				metric.DatapointsMode = DatapointsLatest
+			}
+			if metric.StatisticMode == "" {
+				metric.StatisticMode = settings.StatisticMode
+			}
+			if metric.PrometheusType == "" {
+				metric.PrometheusType = TypeGauge
+			}
+			if metric.TagSelect != nil {
+				metric.TagSelect.setDefaults(metric.Namespace)
+			}
+		}
+	}
+}
+
+// Contains returns true if the value is in the list.
+func Contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// exportShape is what the series sharing a name must agree on to be registered together: their help and label names.
+type exportShape struct {
+	help   string
+	labels string
+	pos    string
+}
+
+// exportShapes maps the names exported by the tasks sharing a name to their shape.
+// Tasks sharing a name are scraped, and registered, together.
+type exportShapes map[string]exportShape
+
+// check records the shape of a name, and returns the problem found if the name is already exported with another shape.
+func (shapes exportShapes) check(name string, help string, labels []string, constLabels map[string]string, pos string) []string {
+	names := append([]string{}, labels...)
+	for label := range constLabels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	shape := exportShape{help: help, labels: strings.Join(names, ","), pos: pos}
+
+	previous, ok := shapes[name]
+	if !ok {
+		shapes[name] = shape
+		return nil
+	}
+	if previous.labels != shape.labels {
+		return []string{fmt.Sprintf("%s: %s is exported with labels [%s], but with [%s] by %s", pos, name, shape.labels, previous.labels, previous.pos)}
+	}
+	if previous.help != shape.help {
+		return []string{fmt.Sprintf("%s: %s is exported with help %q, but with %q by %s", pos, name, shape.help, previous.help, previous.pos)}
+	}
+	return nil
+}
+
+// validPeriod returns true if CloudWatch accepts the period: 1, 5, 10, 30 or any multiple of 60.
+func validPeriod(period int) bool {
+	switch period {
+	case 1, 5, 10, 30:
+		return true
+	}
+	return period > 0 && period%60 == 0
+}
+
+// validate checks the settings and returns a ValidationError listing every problem found.
+func (settings *Settings) validate() error {
+	var errs []string
+
+	if settings.MetricPrefix != "" && !MetricNameRegex.MatchString(settings.MetricPrefix) {
+		errs = append(errs, fmt.Sprintf("metric_prefix: %q isn't a valid metric name prefix", settings.MetricPrefix))
+	}
+
+	if settings.StatisticMode != StatisticLabel && settings.StatisticMode != StatisticSuffix {
+		errs = append(errs, fmt.Sprintf("statistic_mode: unknown mode %q", settings.StatisticMode))
+	}
+
+	if retry := settings.Retry; retry != nil {
+		if retry.MaxAttempts < 1 {
+			errs = append(errs, "retry: max_attempts must be at least 1")
+		}
+		if retry.BaseDelaySeconds < 0 || retry.ThrottleDelaySeconds < 0 || retry.MaxDelaySeconds < 0 {
+			errs = append(errs, "retry: delays can't be negative")
+		}
+		for _, code := range retry.RetryCodes {
+			if Contains(retry.NoRetryCodes, code) {
+				errs = append(errs, fmt.Sprintf("retry: %s can't be in both retry_codes and no_retry_codes", code))
+			}
+		}
+	}
+
+	accountIDs := map[string]bool{}
+	for a, account := range settings.Accounts {
+		accountPos := fmt.Sprintf("accounts %d (%s)", a, account.ID)
+		if account.ID == "" {
+			errs = append(errs, fmt.Sprintf("%s: id is required", accountPos))
+		} else if accountIDs[account.ID] {
+			errs = append(errs, fmt.Sprintf("%s: account is listed several times", accountPos))
+		}
+		accountIDs[account.ID] = true
+
+		for name := range account.Metadata {
+			if !LabelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+				errs = append(errs, fmt.Sprintf("%s: %q isn't a valid label name", accountPos, name))
+			} else if reservedLabels[name] {
+				errs = append(errs, fmt.Sprintf("%s: label %q is reserved", accountPos, name))
+			}
+		}
+	}
+
+	if discovery := settings.AccountsDiscovery; discovery != nil {
+		if len(settings.Accounts) > 0 {
+			errs = append(errs, "accounts_discovery: accounts can't be set when accounts are discovered")
+		}
+		if discovery.Account != "" && discovery.RoleName == "" {
+			errs = append(errs, "accounts_discovery: role_name is required when account is set")
+		}
+		if discovery.RefreshIntervalSeconds < 0 {
+			errs = append(errs, "accounts_discovery: refresh_interval_seconds can't be negative")
+		}
+	}
+
+	// Relabelled series are only named once scraped, the names of the others are checked for each task name
+	metadataLabels := settings.MetadataLabels()
+	shapes := map[string]exportShapes{}
+
+	for t, task := range settings.Tasks {
+		taskPos := fmt.Sprintf("task %d (%s)", t, task.Name)
+		if shapes[task.Name] == nil {
+			shapes[task.Name] = exportShapes{}
+		}
+
+		if task.Name == "" {
+			errs = append(errs, fmt.Sprintf("%s: name is required", taskPos))
+		}
+		if task.Region != "" && len(task.Regions) > 0 {
+			errs = append(errs, fmt.Sprintf("%s: region and regions can't both be set", taskPos))
+		}
+		if task.Account != "" && task.RoleName == "" {
+			errs = append(errs, fmt.Sprintf("%s: role_name is required when account is set", taskPos))
+		}
+		if len(task.Metrics) == 0 {
+			errs = append(errs, fmt.Sprintf("%s: at least one metric is required", taskPos))
+		}
+
+		for r, relabel := range task.RelabelConfigs {
+			for _, err := range relabel.compile() {
+				errs = append(errs, fmt.Sprintf("%s, relabel_configs %d: %s", taskPos, r, err))
+			}
+		}
+
+		// Maps the ids of the metrics to the metrics, for the expressions to reference them
+		ids := map[string]*Metric{}
+
+		for m, metric := range task.Metrics {
+			metricPos := fmt.Sprintf("%s, metric %d (%s %s)", taskPos, m, metric.Namespace, metric.Name)
+
+			if metric.Namespace == "" {
+				errs = append(errs, fmt.Sprintf("%s: aws_namespace is required", metricPos))
+			}
+			if metric.Name == "" {
+				errs = append(errs, fmt.Sprintf("%s: aws_metric_name is required", metricPos))
+			}
+
+			if len(metric.Statistics) == 0 && len(metric.ExtendedStatistics) == 0 {
+				errs = append(errs, fmt.Sprintf("%s: at least one of aws_statistics or aws_extended_statistics is required", metricPos))
+			}
+			for _, stat := range metric.Statistics {
+				if !validStatistics[stat] {
+					errs = append(errs, fmt.Sprintf("%s: unknown statistic %q", metricPos, stat))
+				}
+			}
+			for _, stat := range metric.ExtendedStatistics {
+				if !extendedStatisticRegex.MatchString(stat) {
+					errs = append(errs, fmt.Sprintf("%s: unknown extended statistic %q", metricPos, stat))
+				}
+			}
+
+			if !validPeriod(metric.PeriodSeconds) {
+				errs = append(errs, fmt.Sprintf("%s: period_seconds must be 1, 5, 10, 30 or a multiple of 60, got %d", metricPos, metric.PeriodSeconds))
+			}
+			if metric.RangeSeconds < metric.PeriodSeconds {
+				errs = append(errs, fmt.Sprintf("%s: range_seconds (%d) is shorter than period_seconds (%d)", metricPos, metric.RangeSeconds, metric.PeriodSeconds))
+			}
+			if metric.DelaySeconds < 0 {
+				errs = append(errs, fmt.Sprintf("%s: delay_seconds can't be negative", metricPos))
+			}
+
+			if metric.PrometheusName != "" && !MetricNameRegex.MatchString(metric.PrometheusName) {
+				errs = append(errs, fmt.Sprintf("%s: prometheus_name %q isn't a valid metric name", metricPos, metric.PrometheusName))
+			}
+			for name := range metric.Labels {
+				if !LabelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+					errs = append(errs, fmt.Sprintf("%s: %q isn't a valid label name", metricPos, name))
+				} else if reservedLabels[name] {
+					errs = append(errs, fmt.Sprintf("%s: label %q is reserved", metricPos, name))
+				}
+			}
+
+			if !validDatapointsModes[metric.DatapointsMode] {
+				errs = append(errs, fmt.Sprintf("%s: unknown datapoints_mode %q", metricPos, metric.DatapointsMode))
+			}
+			if metric.Search && len(metric.Dimensions) == 0 {
+				errs = append(errs, fmt.Sprintf("%s: aws_search needs aws_dimensions", metricPos))
+			}
+			if _, ok := baseUnits[metric.Unit]; metric.Unit != "" && !ok {
+				errs = append(errs, fmt.Sprintf("%s: unknown aws_unit %q", metricPos, metric.Unit))
+			}
+			if !validPrometheusTypes[metric.PrometheusType] {
+				errs = append(errs, fmt.Sprintf("%s: unknown prometheus_type %q", metricPos, metric.PrometheusType))
+			}
+			if metric.PrometheusType == TypeCumulative {
+				if len(metric.Statistics) != 1 || metric.Statistics[0] != "Sum" || len(metric.ExtendedStatistics) > 0 {
+					errs = append(errs, fmt.Sprintf("%s: prometheus_type cumulative only works with the Sum statistic alone", metricPos))
+				}
+				if metric.DatapointsMode != DatapointsLatest {
+					errs = append(errs, fmt.Sprintf("%s: prometheus_type cumulative can't be used with datapoints_mode %s", metricPos, metric.DatapointsMode))
+				}
+			}
+			if metric.StatisticMode != StatisticLabel && metric.StatisticMode != StatisticSuffix {
+				errs = append(errs, fmt.Sprintf("%s: unknown statistic_mode %q", metricPos, metric.StatisticMode))
+			}
+			if metric.RecentlyActive != "" && metric.RecentlyActive != "PT3H" {
+				errs = append(errs, fmt.Sprintf("%s: recently_active only accepts PT3H, got %q", metricPos, metric.RecentlyActive))
+			}
+
+			for dimension, regex := range metric.DimensionsSelectRegex {
+				if _, err := regexp.Compile(regex); err != nil {
+					errs = append(errs, fmt.Sprintf("%s: invalid aws_dimensions_select_regex for %s: %s", metricPos, dimension, err))
+				}
+			}
+
+			for r, relabel := range metric.RelabelConfigs {
+				for _, err := range relabel.compile() {
+					errs = append(errs, fmt.Sprintf("%s, relabel_configs %d: %s", metricPos, r, err))
+				}
+			}
+
+			if tagSelect := metric.TagSelect; tagSelect != nil {
+				if len(tagSelect.TagSelections) == 0 {
+					errs = append(errs, fmt.Sprintf("%s: aws_tag_select needs at least one tag in tag_selections", metricPos))
+				}
+				if tagSelect.ResourceIDDimension == "" {
+					errs = append(errs, fmt.Sprintf("%s: aws_tag_select needs resource_id_dimension, %s has no built-in mapping", metricPos, metric.Namespace))
+				} else if !Contains(metric.Dimensions, tagSelect.ResourceIDDimension) {
+					errs = append(errs, fmt.Sprintf("%s: aws_tag_select resource_id_dimension %s must be in aws_dimensions", metricPos, tagSelect.ResourceIDDimension))
+				}
+			}
+
+			if metric.ID != "" {
+				if !idRegex.MatchString(metric.ID) {
+					errs = append(errs, fmt.Sprintf("%s: id %q must start with a lowercase letter and only contain letters, digits and underscores", metricPos, metric.ID))
+				} else if _, ok := ids[metric.ID]; ok {
+					errs = append(errs, fmt.Sprintf("%s: id %q is used several times", metricPos, metric.ID))
+				}
+				ids[metric.ID] = &settings.Tasks[t].Metrics[m]
+			}
+
+			if len(task.RelabelConfigs) == 0 && len(metric.RelabelConfigs) == 0 {
+				for _, stat := range append(append([]string{}, metric.Statistics...), metric.ExtendedStatistics...) {
+					name, help, _ := metric.ExportedStatistic(settings.MetricPrefix, stat)
+					errs = append(errs, shapes[task.Name].check(name, help, metric.GeneratedLabels(metadataLabels), metric.Labels, metricPos)...)
+				}
+			}
+		}
+
+		// Ids already used by a metric are reported once, they still reference the metric
+		expressionIDs := map[string]bool{}
+		for _, expression := range task.Expressions {
+			if _, ok := ids[expression.ID]; !ok {
+				expressionIDs[expression.ID] = true
+			}
+		}
+
+		seenExpressions := map[string]bool{}
+		for e := range task.Expressions {
+			expression := &settings.Tasks[t].Expressions[e]
+			expressionPos := fmt.Sprintf("%s, expression %d (%s)", taskPos, e, expression.ID)
+			if seenExpressions[expression.ID] {
+				errs = append(errs, fmt.Sprintf("%s: id %q is used several times", expressionPos, expression.ID))
+			}
+			seenExpressions[expression.ID] = true
+			errs = append(errs, expression.validate(expressionPos, ids, expressionIDs)...)
+
+			// Expressions have the labels of the first metric they reference, without its statistic
+			if len(task.RelabelConfigs) == 0 && len(expression.References) > 0 {
+				reference := ids[expression.References[0]]
+				labels := reference.GeneratedLabels(metadataLabels)
+				if reference.StatisticMode == StatisticLabel {
+					labels = labels[:len(labels)-1]
+				}
+				name, help := expression.ExportedName(settings.MetricPrefix)
+				errs = append(errs, shapes[task.Name].check(name, help, labels, nil, expressionPos)...)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// validate checks an expression and resolves the metrics it references. It returns the problems found.
+// The metrics of an expression are requested together, so they must share a single statistic, their window and their dimensions.
+// Expressions are only evaluated next to the queries of their metrics, so they can't reference the other expressions of the task.
+func (expression *Expression) validate(pos string, ids map[string]*Metric, expressionIDs map[string]bool) []string {
+	var errs []string
+
+	if !idRegex.MatchString(expression.ID) {
+		errs = append(errs, fmt.Sprintf("%s: id %q must start with a lowercase letter and only contain letters, digits and underscores", pos, expression.ID))
+	} else if _, ok := ids[expression.ID]; ok {
+		errs = append(errs, fmt.Sprintf("%s: id %q is already used by a metric", pos, expression.ID))
+	}
+	if expression.Expression == "" {
+		errs = append(errs, fmt.Sprintf("%s: expression is required", pos))
+	}
+	if expression.Name != "" && !MetricNameRegex.MatchString(expression.Name) {
+		errs = append(errs, fmt.Sprintf("%s: name %q isn't a valid metric name", pos, expression.Name))
+	}
+
+	expression.References = nil
+	var first *Metric
+	var rejected []string
+	for _, token := range expression.tokens() {
+		if expressionIDs[token] {
+			if !Contains(rejected, token) {
+				rejected = append(rejected, token)
+				errs = append(errs, fmt.Sprintf("%s: expression %s can't be referenced, only metrics can", pos, token))
+			}
+			continue
+		}
+		metric, ok := ids[token]
+		if !ok || Contains(expression.References, token) {
+			continue
+		}
+		expression.References = append(expression.References, token)
+
+		if len(metric.Statistics)+len(metric.ExtendedStatistics) != 1 {
+			errs = append(errs, fmt.Sprintf("%s: metric %s must have a single statistic", pos, token))
+		}
+		if metric.Search {
+			errs = append(errs, fmt.Sprintf("%s: metric %s can't use aws_search", pos, token))
+		}
+		if first == nil {
+			first = metric
+			continue
+		}
+		if metric.RangeSeconds != first.RangeSeconds || metric.PeriodSeconds != first.PeriodSeconds || metric.DelaySeconds != first.DelaySeconds {
+			errs = append(errs, fmt.Sprintf("%s: metric %s must have the same range_seconds, period_seconds and delay_seconds as metric %s", pos, token, first.ID))
+		}
+		if strings.Join(metric.Dimensions, ",") != strings.Join(first.Dimensions, ",") {
+			errs = append(errs, fmt.Sprintf("%s: metric %s must have the same aws_dimensions as metric %s", pos, token, first.ID))
+		}
+	}
+	if expression.Expression != "" && len(expression.References) == 0 {
+		errs = append(errs, fmt.Sprintf("%s: expression doesn't reference any metric id", pos))
+	}
+
+	return errs
+}
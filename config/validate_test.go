@@ -0,0 +1,574 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// parse reads the settings the way Load does, without a file.
+func parse(t *testing.T, content string) (*Settings, error) {
+	t.Helper()
+
+	settings := &Settings{}
+	if err := yaml.Unmarshal([]byte(content), settings); err != nil {
+		t.Fatal(err)
+	}
+	settings.setDefaults()
+	return settings, settings.validate()
+}
+
+func TestDefaults(t *testing.T) {
+	settings, err := parse(t, `
+accounts_discovery: {}
+tasks:
+  - name: ec2
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_statistics: [Average]
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	metric := settings.Tasks[0].Metrics[0]
+	if metric.RangeSeconds != DefaultRangeSeconds || metric.PeriodSeconds != DefaultPeriodSeconds {
+		t.Errorf("expected range %d and period %d, got %d and %d", DefaultRangeSeconds, DefaultPeriodSeconds, metric.RangeSeconds, metric.PeriodSeconds)
+	}
+	if metric.DatapointsMode != DatapointsLatest || metric.StatisticMode != StatisticLabel || metric.PrometheusType != TypeGauge {
+		t.Errorf("unexpected modes %s, %s and %s", metric.DatapointsMode, metric.StatisticMode, metric.PrometheusType)
+	}
+	if settings.AccountsDiscovery.RefreshIntervalSeconds != DefaultDiscoveryRefreshSeconds {
+		t.Errorf("expected refresh interval %d, got %d", DefaultDiscoveryRefreshSeconds, settings.AccountsDiscovery.RefreshIntervalSeconds)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics string
+		errs    []string
+	}{
+		{
+			name: "valid metric",
+			metrics: `
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average, Maximum]
+        aws_extended_statistics: [p99, p99.9]
+        period_seconds: 300
+        range_seconds: 900
+        labels: {env: prod}
+`,
+		},
+		{
+			name: "missing fields",
+			metrics: `
+      - period_seconds: 60
+`,
+			errs: []string{
+				"aws_namespace is required",
+				"aws_metric_name is required",
+				"at least one of aws_statistics or aws_extended_statistics is required",
+			},
+		},
+		{
+			name: "unknown statistics",
+			metrics: `
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_statistics: [Avg]
+        aws_extended_statistics: [p101]
+`,
+			errs: []string{`unknown statistic "Avg"`, `unknown extended statistic "p101"`},
+		},
+		{
+			name: "period and range",
+			metrics: `
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_statistics: [Average]
+        period_seconds: 90
+        range_seconds: 60
+        delay_seconds: -1
+`,
+			errs: []string{
+				"period_seconds must be 1, 5, 10, 30 or a multiple of 60, got 90",
+				"range_seconds (60) is shorter than period_seconds (90)",
+				"delay_seconds can't be negative",
+			},
+		},
+		{
+			name: "names and labels",
+			metrics: `
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_statistics: [Average]
+        prometheus_name: ec2-cpu
+        labels: {region: eu, __env: prod, 1env: prod}
+`,
+			errs: []string{
+				`prometheus_name "ec2-cpu" isn't a valid metric name`,
+				`label "region" is reserved`,
+				`"__env" isn't a valid label name`,
+				`"1env" isn't a valid label name`,
+			},
+		},
+		{
+			name: "modes and types",
+			metrics: `
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_statistics: [Average]
+        aws_unit: Percents
+        datapoints_mode: first
+        statistic_mode: prefix
+        prometheus_type: histogram
+        recently_active: PT1H
+`,
+			errs: []string{
+				`unknown aws_unit "Percents"`,
+				`unknown datapoints_mode "first"`,
+				`unknown statistic_mode "prefix"`,
+				`unknown prometheus_type "histogram"`,
+				`recently_active only accepts PT3H, got "PT1H"`,
+			},
+		},
+		{
+			name: "cumulative",
+			metrics: `
+      - aws_namespace: AWS/Lambda
+        aws_metric_name: Invocations
+        aws_statistics: [Sum, Average]
+        datapoints_mode: all
+        prometheus_type: cumulative
+`,
+			errs: []string{
+				"prometheus_type cumulative only works with the Sum statistic alone",
+				"prometheus_type cumulative can't be used with datapoints_mode all",
+			},
+		},
+		{
+			name: "regexes",
+			metrics: `
+      - aws_namespace: AWS/Lambda
+        aws_metric_name: Invocations
+        aws_dimensions: [FunctionName]
+        aws_dimensions_select_regex: {FunctionName: "prod-("}
+        aws_statistics: [Sum]
+        relabel_configs:
+          - regex: "("
+            target_label: function
+          - action: hashmod
+          - action: rename
+`,
+			errs: []string{
+				"invalid aws_dimensions_select_regex for FunctionName",
+				`relabel_configs 0: invalid regex "("`,
+				"relabel_configs 1: target_label is required for the hashmod action",
+				"relabel_configs 1: modulus is required for the hashmod action",
+				`relabel_configs 2: unknown action "rename"`,
+			},
+		},
+		{
+			name: "search and tags",
+			metrics: `
+      - aws_namespace: AWS/Lambda
+        aws_metric_name: Invocations
+        aws_statistics: [Sum]
+        aws_search: true
+      - aws_namespace: Custom
+        aws_metric_name: Requests
+        aws_dimensions: [Service]
+        aws_statistics: [Sum]
+        aws_tag_select:
+          tag_selections: {env: [prod]}
+`,
+			errs: []string{
+				"metric 0 (AWS/Lambda Invocations): aws_search needs aws_dimensions",
+				"metric 1 (Custom Requests): aws_tag_select needs resource_id_dimension, Custom has no built-in mapping",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parse(t, "tasks:\n  - name: test\n    region: eu-west-1\n    metrics:"+test.metrics)
+			checkErrors(t, err, test.errs)
+		})
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errs   []string
+	}{
+		{
+			name: "global fields",
+			config: `
+metric_prefix: "1aws"
+statistic_mode: prefix
+retry:
+  max_attempts: -1
+  base_delay_seconds: -1
+  retry_codes: [Throttling]
+  no_retry_codes: [Throttling]
+tasks: []
+`,
+			errs: []string{
+				`metric_prefix: "1aws" isn't a valid metric name prefix`,
+				`statistic_mode: unknown mode "prefix"`,
+				"retry: max_attempts must be at least 1",
+				"retry: delays can't be negative",
+				"retry: Throttling can't be in both retry_codes and no_retry_codes",
+			},
+		},
+		{
+			name: "accounts",
+			config: `
+accounts:
+  - id: "111"
+    metadata: {team: data, task: ec2}
+  - id: "111"
+  - name: missing
+accounts_discovery:
+  account: "222"
+tasks: []
+`,
+			errs: []string{
+				`accounts 0 (111): label "task" is reserved`,
+				"accounts 1 (111): account is listed several times",
+				"accounts 2 (): id is required",
+				"accounts_discovery: accounts can't be set when accounts are discovered",
+				"accounts_discovery: role_name is required when account is set",
+			},
+		},
+		{
+			name: "tasks",
+			config: `
+tasks:
+  - region: eu-west-1
+    regions: [us-east-1]
+    account: "111"
+    metrics: []
+`,
+			errs: []string{
+				"task 0 (): name is required",
+				"task 0 (): region and regions can't both be set",
+				"task 0 (): role_name is required when account is set",
+				"task 0 (): at least one metric is required",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parse(t, test.config)
+			checkErrors(t, err, test.errs)
+		})
+	}
+}
+
+func TestValidateExpressions(t *testing.T) {
+	tests := []struct {
+		name        string
+		expressions string
+		references  []string
+		errs        []string
+	}{
+		{
+			name: "valid expression",
+			expressions: `
+      - id: error_rate
+        expression: "errors / (invocations + errors) * 100"
+`,
+			references: []string{"errors", "invocations"},
+		},
+		{
+			name: "ids",
+			expressions: `
+      - id: errors
+        expression: errors * 2
+      - id: Rate
+        expression: errors * 2
+      - id: double
+        expression: errors * 2
+      - id: double
+        expression: errors * 2
+`,
+			errs: []string{
+				`expression 0 (errors): id "errors" is already used by a metric`,
+				`expression 1 (Rate): id "Rate" must start with a lowercase letter`,
+				`expression 3 (double): id "double" is used several times`,
+			},
+		},
+		{
+			name: "references",
+			expressions: `
+      - id: constant
+        expression: "SUM(METRICS('unknown'))"
+      - id: double
+        expression: errors * 2
+      - id: nested
+        expression: double + double / errors
+`,
+			errs: []string{
+				"expression 0 (constant): expression doesn't reference any metric id",
+				"expression 2 (nested): expression double can't be referenced, only metrics can",
+			},
+		},
+		{
+			name: "metrics requested together",
+			expressions: `
+      - id: mixed
+        expression: errors + duration + throttles
+`,
+			errs: []string{
+				"expression 0 (mixed): metric duration must have a single statistic",
+				"expression 0 (mixed): metric duration must have the same range_seconds, period_seconds and delay_seconds as metric errors",
+				"expression 0 (mixed): metric throttles must have the same aws_dimensions as metric errors",
+			},
+		},
+	}
+
+	metrics := `
+tasks:
+  - name: lambda
+    region: eu-west-1
+    metrics:
+      - id: errors
+        aws_namespace: AWS/Lambda
+        aws_metric_name: Errors
+        aws_dimensions: [FunctionName]
+        aws_statistics: [Sum]
+      - id: invocations
+        aws_namespace: AWS/Lambda
+        aws_metric_name: Invocations
+        aws_dimensions: [FunctionName]
+        aws_statistics: [Sum]
+      - id: duration
+        aws_namespace: AWS/Lambda
+        aws_metric_name: Duration
+        aws_dimensions: [FunctionName]
+        aws_statistics: [Average, Maximum]
+        statistic_mode: suffix
+        period_seconds: 300
+      - id: throttles
+        aws_namespace: AWS/Lambda
+        aws_metric_name: Throttles
+        aws_statistics: [Sum]
+    expressions:`
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := parse(t, metrics+test.expressions)
+			checkErrors(t, err, test.errs)
+			if test.references != nil && !reflect.DeepEqual(settings.Tasks[0].Expressions[0].References, test.references) {
+				t.Errorf("expected references %v, got %v", test.references, settings.Tasks[0].Expressions[0].References)
+			}
+		})
+	}
+}
+
+func TestValidateShapes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errs   []string
+	}{
+		{
+			name: "same metric with other dimensions and another name",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        prometheus_name: ec2_instance_cpu
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [AutoScalingGroupName]
+        aws_statistics: [Average]
+        prometheus_name: ec2_asg_cpu
+`,
+		},
+		{
+			name: "same name with other dimensions",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        prometheus_name: ec2_cpu
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUCreditBalance
+        aws_dimensions: [AutoScalingGroupName]
+        aws_statistics: [Average]
+        prometheus_name: ec2_cpu
+        help: EC2 CPU
+`,
+			errs: []string{"task 0 (ec2), metric 1 (AWS/EC2 CPUCreditBalance): ec2_cpu is exported with labels [account,account_name,auto_scaling_group_name,region,statistic,task], but with [account,account_name,instance_id,region,statistic,task] by task 0 (ec2), metric 0 (AWS/EC2 CPUUtilization)"},
+		},
+		{
+			name: "tasks sharing a name",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+  - name: ec2
+    region: us-east-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [AutoScalingGroupName]
+        aws_statistics: [Average]
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        help: CPU
+`,
+			errs: []string{
+				"task 1 (ec2), metric 0 (AWS/EC2 CPUUtilization): aws_ec2_cpu_utilization is exported with labels",
+				`task 1 (ec2), metric 1 (AWS/EC2 CPUUtilization): aws_ec2_cpu_utilization is exported with help "CPU"`,
+			},
+		},
+		{
+			name: "statistic suffixes",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        statistic_mode: suffix
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [AutoScalingGroupName]
+        aws_statistics: [Maximum]
+        statistic_mode: suffix
+`,
+		},
+		{
+			name: "different help",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        statistic_mode: suffix
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        statistic_mode: suffix
+        help: CPU
+`,
+			errs: []string{"aws_ec2_cpu_utilization_average is exported with help"},
+		},
+		{
+			name: "expression named like a metric",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - id: cpu
+        aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+        prometheus_name: ec2_cpu
+    expressions:
+      - id: cpu_ratio
+        expression: cpu / 100
+        name: ec2_cpu
+`,
+			errs: []string{"task 0 (ec2), expression 0 (cpu_ratio): ec2_cpu is exported with labels [account,account_name,instance_id,region,task]"},
+		},
+		{
+			name: "relabelled metrics aren't checked",
+			config: `
+tasks:
+  - name: ec2
+    region: eu-west-1
+    metrics:
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [InstanceId]
+        aws_statistics: [Average]
+      - aws_namespace: AWS/EC2
+        aws_metric_name: CPUUtilization
+        aws_dimensions: [AutoScalingGroupName]
+        aws_statistics: [Average]
+        relabel_configs:
+          - source_labels: [auto_scaling_group_name]
+            target_label: instance_id
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parse(t, test.config)
+			checkErrors(t, err, test.errs)
+		})
+	}
+}
+
+// checkErrors checks that err is a ValidationError holding exactly the expected problems, each matched by a substring.
+func checkErrors(t *testing.T, err error, expected []string) {
+	t.Helper()
+
+	if len(expected) == 0 {
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		return
+	}
+
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if len(validationErr.Errors) != len(expected) {
+		t.Errorf("expected %d errors, got %d:\n  %s", len(expected), len(validationErr.Errors), strings.Join(validationErr.Errors, "\n  "))
+	}
+	for _, substring := range expected {
+		found := false
+		for _, message := range validationErr.Errors {
+			if strings.Contains(message, substring) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected an error containing %q, got:\n  %s", substring, strings.Join(validationErr.Errors, "\n  "))
+		}
+	}
+}
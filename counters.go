@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// counterExpiry is how long a cumulative counter is kept without new datapoints before it's forgotten.
+const counterExpiry = time.Hour
+
+// cumulativeCounter is the running total of the Sum datapoints of a series.
+type cumulativeCounter struct {
+	total float64
+	// seen holds the values of the datapoints already added by timestamp, to not count them twice across scrapes
+	seen    map[time.Time]float64
+	updated time.Time
+}
+
+// counterStore holds the cumulative counters of all the series, by name and label values.
+// It outlives configuration reloads, so that counters don't reset when the configuration changes.
+type counterStore struct {
+	mutex    sync.Mutex
+	counters map[string]*cumulativeCounter
+	swept    time.Time
+}
+
+var cumulativeCounters = &counterStore{counters: map[string]*cumulativeCounter{}}
+
+// add adds the datapoints which weren't seen yet to the counter of a series and returns its total.
+// The Sum of a period keeps growing while CloudWatch receives late data, a datapoint seen with a higher value only adds the difference.
+// A lower value is ignored, so that the counter never goes down. The datapoints must be sorted.
+func (store *counterStore) add(key string, datapoints []datapoint) float64 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	store.sweep(now)
+
+	counter, ok := store.counters[key]
+	if !ok {
+		counter = &cumulativeCounter{seen: map[time.Time]float64{}}
+		store.counters[key] = counter
+	}
+	counter.updated = now
+
+	for _, dp := range datapoints {
+		previous, ok := counter.seen[dp.timestamp]
+		if !ok {
+			counter.seen[dp.timestamp] = dp.value
+			counter.total += dp.value
+		} else if dp.value > previous {
+			counter.seen[dp.timestamp] = dp.value
+			counter.total += dp.value - previous
+		}
+	}
+
+	// The window only moves forward, datapoints older than the oldest one returned won't come back
+	for timestamp := range counter.seen {
+		if timestamp.Before(datapoints[0].timestamp) {
+			delete(counter.seen, timestamp)
+		}
+	}
+
+	return counter.total
+}
+
+// sweep forgets the counters of the series which stopped receiving datapoints. The lock must be held by the caller.
+func (store *counterStore) sweep(now time.Time) {
+	if now.Sub(store.swept) < counterExpiry {
+		return
+	}
+	store.swept = now
+
+	for key, counter := range store.counters {
+		if now.Sub(counter.updated) > counterExpiry {
+			delete(store.counters, key)
+		}
+	}
+}
+
+// counterKey returns the key of the counter of an exported series.
+func counterKey(series outputSeries) string {
+	return series.name + "\xff" + strings.Join(series.labels, "\xff")
+}
+
+// valueType returns the Prometheus value type of a prometheus_type.
+func valueType(prometheusType string) prometheus.ValueType {
+	switch prometheusType {
+	case config.TypeCounter, config.TypeCumulative:
+		return prometheus.CounterValue
+	case config.TypeUntyped:
+		return prometheus.UntypedValue
+	}
+	return prometheus.GaugeValue
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterStoreAdd(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minute int, value float64) datapoint {
+		return datapoint{timestamp: start.Add(time.Duration(minute) * time.Minute), value: value}
+	}
+
+	tests := []struct {
+		name   string
+		scrape [][]datapoint
+		totals []float64
+		seen   int
+	}{
+		{
+			name:   "overlapping windows",
+			scrape: [][]datapoint{{at(0, 1), at(1, 2)}, {at(1, 2), at(2, 3)}, {at(2, 3), at(3, 4)}},
+			totals: []float64{3, 6, 10},
+			seen:   2,
+		},
+		{
+			name:   "revised sum",
+			scrape: [][]datapoint{{at(0, 1), at(1, 2)}, {at(0, 1), at(1, 5)}, {at(1, 7), at(2, 1)}},
+			totals: []float64{3, 6, 9},
+			seen:   2,
+		},
+		{
+			name:   "lower value",
+			scrape: [][]datapoint{{at(0, 5)}, {at(0, 3)}, {at(0, 6)}},
+			totals: []float64{5, 5, 6},
+			seen:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &counterStore{counters: map[string]*cumulativeCounter{}}
+			for i, datapoints := range test.scrape {
+				if total := store.add("key", datapoints); total != test.totals[i] {
+					t.Errorf("scrape %d: expected a total of %g, got %g", i, test.totals[i], total)
+				}
+			}
+
+			// Datapoints older than the window are forgotten
+			if seen := len(store.counters["key"].seen); seen != test.seen {
+				t.Errorf("expected %d datapoints to be remembered, got %d", test.seen, seen)
+			}
+		})
+	}
+}
+
+func TestCounterStoreSweep(t *testing.T) {
+	now := time.Now()
+	store := &counterStore{
+		counters: map[string]*cumulativeCounter{
+			"active":  {total: 1, updated: now.Add(-time.Minute)},
+			"expired": {total: 2, updated: now.Add(-2 * counterExpiry)},
+		},
+		swept: now.Add(-2 * counterExpiry),
+	}
+
+	store.sweep(now)
+	if _, ok := store.counters["expired"]; ok {
+		t.Error("expected the expired counter to be forgotten")
+	}
+	if _, ok := store.counters["active"]; !ok {
+		t.Error("expected the active counter to be kept")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// datapoint is a single value returned by CloudWatch for a series.
+type datapoint struct {
+	timestamp time.Time
+	value     float64
+}
+
+// backfillSample is a datapoint older than the latest one of its series.
+// It can't go through the registry, which rejects several samples of the same series, so it's added to the gathered families afterwards.
+type backfillSample struct {
+	name   string
+	metric prometheus.Metric
+}
+
+// sortDatapoints sorts the datapoints from the oldest to the newest.
+func sortDatapoints(datapoints []datapoint) {
+	sort.Slice(datapoints, func(i, j int) bool {
+		return datapoints[i].timestamp.Before(datapoints[j].timestamp)
+	})
+}
+
+// reduceDatapoints reduces the datapoints of a window to a single one, with the timestamp of the newest datapoint.
+// The datapoints must be sorted.
+func reduceDatapoints(mode string, datapoints []datapoint) datapoint {
+	reduced := datapoints[len(datapoints)-1]
+
+	switch mode {
+	case config.DatapointsMax:
+		for _, dp := range datapoints {
+			if dp.value > reduced.value {
+				reduced.value = dp.value
+			}
+		}
+	case config.DatapointsMin:
+		for _, dp := range datapoints {
+			if dp.value < reduced.value {
+				reduced.value = dp.value
+			}
+		}
+	case config.DatapointsSum, config.DatapointsAvg:
+		sum := 0.0
+		for _, dp := range datapoints {
+			sum += dp.value
+		}
+		reduced.value = sum
+		if mode == config.DatapointsAvg {
+			reduced.value = sum / float64(len(datapoints))
+		}
+	}
+
+	return reduced
+}
+
+// sendDatapoints sends the datapoints of a query according to the datapoints mode of its metric.
+// The datapoints must be sorted.
+func sendDatapoints(collector *Collector, ch chan<- prometheus.Metric, query *dataQuery, datapoints []datapoint) {
+	configMetric := query.metric
+
+	series, ok := querySeries(query)
+	if !ok {
+		return
+	}
+
+	if configMetric.DatapointsMode != config.DatapointsAll {
+		dp := reduceDatapoints(configMetric.DatapointsMode, datapoints)
+		// Cumulative counters export the running total of every datapoint seen so far
+		if configMetric.PrometheusType == config.TypeCumulative {
+			dp.value = cumulativeCounters.add(counterKey(series), datapoints)
+		}
+
+		metric := prometheus.MustNewConstMetric(series.desc, configMetric.ValType, dp.value, series.labels...)
+		if setTimestamp(configMetric) {
+			metric = prometheus.NewMetricWithTimestamp(dp.timestamp, metric)
+		}
+		ch <- metric
+		return
+	}
+
+	// Every datapoint carries its own timestamp, only the newest one goes through the registry
+	for i, dp := range datapoints {
+		metric := prometheus.NewMetricWithTimestamp(dp.timestamp,
+			prometheus.MustNewConstMetric(series.desc, configMetric.ValType, dp.value, series.labels...))
+
+		if i == len(datapoints)-1 {
+			ch <- metric
+		} else {
+			collector.addBackfill(series.name, metric)
+		}
+	}
+}
+
+// backfillGatherer gathers the metrics of a registry and adds the backfill samples buffered by the collector during the scrape.
+type backfillGatherer struct {
+	registry  *prometheus.Registry
+	collector *Collector
+}
+
+// Gather implements prometheus.Gatherer.
+func (gatherer *backfillGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := gatherer.registry.Gather()
+	if err != nil {
+		return families, err
+	}
+
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+
+	for _, sample := range gatherer.collector.backfill {
+		// The newest sample of the series went through the registry, so its family always exists
+		family, ok := byName[sample.name]
+		if !ok {
+			continue
+		}
+
+		metric := &dto.Metric{}
+		if err := sample.metric.Write(metric); err != nil {
+			return families, err
+		}
+		family.Metric = append(family.Metric, metric)
+	}
+
+	// Keep the samples of each series together and in chronological order
+	for _, family := range families {
+		sort.SliceStable(family.Metric, func(i, j int) bool {
+			left, right := labelsKey(family.Metric[i]), labelsKey(family.Metric[j])
+			if left != right {
+				return left < right
+			}
+			return family.Metric[i].GetTimestampMs() < family.Metric[j].GetTimestampMs()
+		})
+	}
+
+	return families, nil
+}
+
+// labelsKey returns a string identifying the series of a sample.
+func labelsKey(metric *dto.Metric) string {
+	pairs := make([]string, 0, len(metric.Label))
+	for _, label := range metric.Label {
+		pairs = append(pairs, label.GetName()+"\xff"+label.GetValue())
+	}
+	return strings.Join(pairs, "\xff")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+func TestReduceDatapoints(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	datapoints := []datapoint{
+		{timestamp: start, value: 3},
+		{timestamp: start.Add(time.Minute), value: 7},
+		{timestamp: start.Add(2 * time.Minute), value: 2},
+	}
+
+	tests := []struct {
+		mode     string
+		expected float64
+	}{
+		{mode: config.DatapointsLatest, expected: 2},
+		{mode: config.DatapointsMax, expected: 7},
+		{mode: config.DatapointsMin, expected: 2},
+		{mode: config.DatapointsSum, expected: 12},
+		{mode: config.DatapointsAvg, expected: 4},
+	}
+
+	for _, test := range tests {
+		reduced := reduceDatapoints(test.mode, datapoints)
+		if reduced.value != test.expected {
+			t.Errorf("%s: expected %g, got %g", test.mode, test.expected, reduced.value)
+		}
+		// The reduced datapoint always has the timestamp of the newest one
+		if !reduced.timestamp.Equal(datapoints[2].timestamp) {
+			t.Errorf("%s: expected the timestamp %s, got %s", test.mode, datapoints[2].timestamp, reduced.timestamp)
+		}
+	}
+}
+
+// staticCollector sends a fixed list of metrics, the way the Collector sends the newest sample of each series.
+type staticCollector struct {
+	metrics []prometheus.Metric
+}
+
+func (collector *staticCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, metric := range collector.metrics {
+		ch <- metric.Desc()
+	}
+}
+
+func (collector *staticCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range collector.metrics {
+		ch <- metric
+	}
+}
+
+func TestBackfillGatherer(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minute int, value float64) datapoint {
+		return datapoint{timestamp: start.Add(time.Duration(minute) * time.Minute), value: value}
+	}
+
+	tests := []struct {
+		name     string
+		series   map[string][]datapoint
+		expected []string
+	}{
+		{
+			name:     "single datapoint",
+			series:   map[string][]datapoint{"a": {at(5, 1)}},
+			expected: []string{"a=1@5"},
+		},
+		{
+			name:     "every datapoint of a series",
+			series:   map[string][]datapoint{"a": {at(0, 1), at(1, 2), at(2, 3)}},
+			expected: []string{"a=1@0", "a=2@1", "a=3@2"},
+		},
+		{
+			name:     "series kept together",
+			series:   map[string][]datapoint{"b": {at(0, 10), at(1, 20)}, "a": {at(0, 1), at(1, 2)}},
+			expected: []string{"a=1@0", "a=2@1", "b=10@0", "b=20@1"},
+		},
+	}
+
+	desc := prometheus.NewDesc("aws_lambda_invocations", "AWS/Lambda Invocations", []string{"function_name"}, nil)
+	metric := &config.Metric{DatapointsMode: config.DatapointsAll, ValType: prometheus.GaugeValue}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			collector := &Collector{}
+			ch := make(chan prometheus.Metric, 10)
+			for function, datapoints := range test.series {
+				query := &dataQuery{metric: metric, labels: []string{function}, name: "aws_lambda_invocations", desc: desc}
+				sendDatapoints(collector, ch, query, datapoints)
+			}
+			close(ch)
+
+			// Only the newest sample of each series goes through the registry, next to the metrics of the exporter
+			sent := &staticCollector{}
+			for metric := range ch {
+				sent.metrics = append(sent.metrics, metric)
+			}
+			scrapeTime := prometheus.NewGauge(prometheus.GaugeOpts{Name: "cloudwatch_exporter_scrape_duration_seconds", Help: "Scrape duration"})
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(sent, scrapeTime)
+
+			families, err := (&backfillGatherer{registry: registry, collector: collector}).Gather()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(families) != 2 {
+				t.Fatalf("expected 2 families, got %d", len(families))
+			}
+
+			var samples []string
+			for _, family := range families {
+				if family.GetName() != "aws_lambda_invocations" {
+					if len(family.Metric) != 1 {
+						t.Errorf("expected the %s family to be kept as it is, got %d samples", family.GetName(), len(family.Metric))
+					}
+					continue
+				}
+				for _, sample := range family.Metric {
+					minute := (sample.GetTimestampMs() - start.UnixNano()/int64(time.Millisecond)) / int64(time.Minute/time.Millisecond)
+					samples = append(samples, fmt.Sprintf("%s=%g@%d", sample.Label[0].GetValue(), sample.GetGauge().GetValue(), minute))
+				}
+			}
+			if !reflect.DeepEqual(samples, test.expected) {
+				t.Errorf("expected samples %v, got %v", test.expected, samples)
+			}
+		})
+	}
+}
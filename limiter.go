@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// APIs whose calls are limited, used as the api label of the limiter metrics
+const (
+	apiGetMetricData = "GetMetricData"
+	apiListMetrics   = "ListMetrics"
+	apiGetResources  = "GetResources"
+)
+
+// throttlingCodes are the error codes AWS APIs return when requests are throttled
+var throttlingCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestLimitExceeded":                   true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+}
+
+// countThrottling counts the error in the throttled requests metric if AWS throttled the attempt.
+func countThrottling(api string, err error) {
+	if awsErr, ok := err.(awserr.Error); ok && throttlingCodes[awsErr.Code()] {
+		throttledRequests.WithLabelValues(api).Inc()
+	}
+}
+
+// tokenBucket limits the rate of calls, allowing bursts of up to one second of calls.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before it can be used.
+// Tokens can be taken in advance, the callers then wait in turn.
+func (bucket *tokenBucket) reserve() time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if burst := bucket.rate; bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// limiterKey identifies the rate limiter of an API in an account and region.
+type limiterKey struct {
+	api     string
+	account string
+	region  string
+}
+
+// apiLimiter bounds the number of concurrent API calls of all the scrapes and the rate of calls per account and region.
+type apiLimiter struct {
+	workers chan struct{}
+	rates   map[string]float64
+
+	mutex   sync.Mutex
+	buckets map[limiterKey]*tokenBucket
+}
+
+var limiter *apiLimiter
+
+// newAPILimiter creates a limiter allowing the given number of concurrent calls, 0 for no limit.
+// rates holds the requests per second allowed for each API in an account and region, APIs without a rate aren't rate limited.
+func newAPILimiter(concurrency int, rates map[string]float64) *apiLimiter {
+	limiter := &apiLimiter{
+		rates:   rates,
+		buckets: map[limiterKey]*tokenBucket{},
+	}
+	if concurrency > 0 {
+		limiter.workers = make(chan struct{}, concurrency)
+	}
+	return limiter
+}
+
+// bucket returns the rate limiter of an API in an account and region, or nil if the API isn't rate limited.
+func (limiter *apiLimiter) bucket(key limiterKey) *tokenBucket {
+	rate := limiter.rates[key.api]
+	if rate <= 0 {
+		return nil
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(rate)
+		limiter.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// acquire waits until a call to the API can be made in the account and region, and returns the function to call once it's done.
+// The time spent waiting is observed in the queue wait metric. It returns an error if the context is done before.
+func (limiter *apiLimiter) acquire(ctx context.Context, api string, account string, region string) (func(), error) {
+	start := time.Now()
+
+	// Waiting for the rate limiter doesn't hold a worker, so that other accounts and regions aren't slowed down
+	if bucket := limiter.bucket(limiterKey{api: api, account: account, region: region}); bucket != nil {
+		if wait := bucket.reserve(); wait > 0 {
+			rateLimitedRequests.WithLabelValues(api).Inc()
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	if limiter.workers != nil {
+		select {
+		case limiter.workers <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	queueWait.WithLabelValues(api).Observe(time.Since(start).Seconds())
+
+	return func() {
+		if limiter.workers != nil {
+			<-limiter.workers
+		}
+	}, nil
+}
+
+// attempts returns a request option which acquires the limiter for every attempt of an API call, rather than once for the whole call.
+// The worker is released as soon as an attempt completes, so calls waiting to be retried don't hold it while they back off.
+// Every throttled attempt is counted, including the ones which are retried.
+func (limiter *apiLimiter) attempts(api string, account string, region string) request.Option {
+	return func(req *request.Request) {
+		var release func()
+
+		// The limiter is acquired once the request is signed, right before it's sent
+		req.Handlers.Sign.PushBackNamed(request.NamedHandler{Name: "exporter.LimiterAcquire", Fn: func(req *request.Request) {
+			if req.Error != nil {
+				return
+			}
+			release, req.Error = limiter.acquire(req.Context(), api, account, region)
+		}})
+		req.Handlers.CompleteAttempt.PushBackNamed(request.NamedHandler{Name: "exporter.LimiterRelease", Fn: func(req *request.Request) {
+			countThrottling(api, req.Error)
+			if release != nil {
+				release()
+				release = nil
+			}
+		}})
+	}
+}
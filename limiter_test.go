@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		waits   []time.Duration
+	}{
+		{
+			name:   "burst then wait in turn",
+			tokens: 2,
+			waits:  []time.Duration{0, 0, 500 * time.Millisecond, time.Second},
+		},
+		{
+			name:    "tokens refill over time",
+			tokens:  -1,
+			elapsed: time.Second,
+			waits:   []time.Duration{0, 500 * time.Millisecond},
+		},
+		{
+			name:    "burst is capped",
+			tokens:  2,
+			elapsed: time.Hour,
+			waits:   []time.Duration{0, 0, 500 * time.Millisecond},
+		},
+		{
+			name:   "reserved in advance",
+			tokens: -3,
+			waits:  []time.Duration{2 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := newTokenBucket(2)
+			bucket.tokens = test.tokens
+			bucket.last = time.Now().Add(-test.elapsed)
+
+			for i, expected := range test.waits {
+				// Time passes between the calls, the waits can only be a little shorter than expected
+				wait := bucket.reserve()
+				if wait > expected || wait < expected-50*time.Millisecond {
+					t.Errorf("call %d: expected a wait of %s, got %s", i, expected, wait)
+				}
+			}
+		})
+	}
+}
+
+func TestAPILimiterAcquire(t *testing.T) {
+	// The limiter metrics are created by main
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "queue_wait_seconds", Help: "Queue wait"}, []string{"api"})
+	limiter := newAPILimiter(1, map[string]float64{})
+
+	release, err := limiter.acquire(context.Background(), apiListMetrics, "111", "eu-west-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The only worker is taken, so the next call waits until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, apiListMetrics, "222", "eu-west-1"); err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	release()
+	release, err = limiter.acquire(context.Background(), apiListMetrics, "222", "eu-west-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	release()
+}
+
+func TestAPILimiterAttempts(t *testing.T) {
+	// The limiter and retry metrics are created by main
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "queue_wait_seconds", Help: "Queue wait"}, []string{"api"})
+	throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "throttled_requests_total", Help: "Throttled"}, []string{"api"})
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "retries_total", Help: "Retries"}, []string{"api", "code"})
+
+	currentRetryPolicy.Store(&config.RetryPolicy{MaxAttempts: 2, BaseDelaySeconds: 0.01, ThrottleDelaySeconds: 0.5, MaxDelaySeconds: 0.5})
+	defer currentRetryPolicy.Store(config.DefaultRetryPolicy())
+
+	// The first call to the Throttled namespace is throttled, every other call succeeds
+	throttled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("Namespace") == "Throttled" && throttled != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("<ErrorResponse><Error><Type>Sender</Type><Code>Throttling</Code><Message>Rate exceeded</Message></Error><RequestId>1</RequestId></ErrorResponse>"))
+			close(throttled)
+			throttled = nil
+			return
+		}
+		w.Write([]byte("<ListMetricsResponse><ListMetricsResult><Metrics></Metrics></ListMetricsResult><ResponseMetadata><RequestId>2</RequestId></ResponseMetadata></ListMetricsResponse>"))
+	}))
+	defer server.Close()
+	wait := throttled
+
+	svc := cloudwatch.New(session.Must(session.NewSession(withRetryer(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+	}))))
+	limiter := newAPILimiter(1, map[string]float64{})
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := svc.ListMetricsWithContext(ctx, &cloudwatch.ListMetricsInput{Namespace: aws.String("Throttled")}, limiter.attempts(apiListMetrics, "111", "eu-west-1"))
+		done <- err
+	}()
+
+	// The throttled call backs off for at least 250ms, without holding the only worker
+	<-wait
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := svc.ListMetricsWithContext(ctx, &cloudwatch.ListMetricsInput{Namespace: aws.String("Other")}, limiter.attempts(apiListMetrics, "222", "eu-west-1")); err != nil {
+		t.Errorf("unexpected error while the throttled call backs off: %s", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("expected the throttled call to be retried, got %s", err)
+	}
+	if len(limiter.workers) != 0 {
+		t.Errorf("expected every worker to be released, %d are held", len(limiter.workers))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// listMetricsKey identifies the ListMetrics results of a metric in an account and region.
+type listMetricsKey struct {
+	namespace      string
+	metricName     string
+	account        string
+	region         string
+	filters        string
+	recentlyActive string
+}
+
+// listMetricsEntry holds every page of ListMetrics results until they expire.
+type listMetricsEntry struct {
+	metrics []*cloudwatch.Metric
+	expires time.Time
+}
+
+// listMetricsCache keeps the results of ListMetrics so that the available dimensions aren't listed on every scrape.
+type listMetricsCache struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[listMetricsKey]*listMetricsEntry
+}
+
+var listMetricsResults = newListMetricsCache(0)
+
+// newListMetricsCache creates a cache keeping the results for ttl. A ttl of 0 disables the cache.
+func newListMetricsCache(ttl time.Duration) *listMetricsCache {
+	return &listMetricsCache{
+		ttl:     ttl,
+		entries: map[listMetricsKey]*listMetricsEntry{},
+	}
+}
+
+func (cache *listMetricsCache) get(key listMetricsKey) ([]*cloudwatch.Metric, bool) {
+	if cache.ttl <= 0 {
+		return nil, false
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil, false
+	}
+	return entry.metrics, true
+}
+
+func (cache *listMetricsCache) set(key listMetricsKey, metrics []*cloudwatch.Metric) {
+	if cache.ttl <= 0 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries[key] = &listMetricsEntry{
+		metrics: metrics,
+		expires: time.Now().Add(cache.ttl),
+	}
+}
+
+// dimensionFilters returns the filters ListMetrics can apply server side.
+// Dimensions selecting a single value are filtered on that value, the others only need to be present.
+func dimensionFilters(configMetric *config.Metric, target string) []*cloudwatch.DimensionFilter {
+	filters := []*cloudwatch.DimensionFilter{}
+
+	for _, name := range configMetric.Dimensions {
+		filter := &cloudwatch.DimensionFilter{
+			Name: aws.String(name),
+		}
+
+		_, hasRegex := configMetric.DimensionsSelectRegex[name]
+		if selected := configMetric.DimensionsSelect[name]; !hasRegex && len(selected) == 1 {
+			value := selected[0]
+			// Replace $_target token by the actual URL target
+			if value == "$_target" {
+				value = target
+			}
+			filter.Value = aws.String(value)
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return filters
+}
+
+// filtersKey returns a string identifying a set of dimension filters.
+func filtersKey(filters []*cloudwatch.DimensionFilter) string {
+	parts := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		parts = append(parts, fmt.Sprintf("%s=%s", aws.StringValue(filter.Name), aws.StringValue(filter.Value)))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// listMetrics returns every page of ListMetrics results for a metric, from the cache if they are still fresh.
+func listMetrics(ctx context.Context, collector *Collector, svc *cloudwatch.CloudWatch, configMetric *config.Metric, task *config.Task, target string) ([]*cloudwatch.Metric, error) {
+	params := &cloudwatch.ListMetricsInput{
+		MetricName: aws.String(configMetric.Name),
+		Namespace:  aws.String(configMetric.Namespace),
+		Dimensions: dimensionFilters(configMetric, target),
+	}
+	if len(configMetric.RecentlyActive) > 0 {
+		params.RecentlyActive = aws.String(configMetric.RecentlyActive)
+	}
+
+	key := listMetricsKey{
+		namespace:      configMetric.Namespace,
+		metricName:     configMetric.Name,
+		account:        task.Account,
+		region:         task.Region,
+		filters:        filtersKey(params.Dimensions),
+		recentlyActive: configMetric.RecentlyActive,
+	}
+	if metrics, ok := listMetricsResults.get(key); ok {
+		return metrics, nil
+	}
+
+	metrics := []*cloudwatch.Metric{}
+	for {
+		result, err := svc.ListMetricsWithContext(ctx, params, limiter.attempts(apiListMetrics, task.Account, task.Region))
+		totalRequests.Inc()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			collector.ErroneousRequests.Inc()
+			return nil, err
+		}
+
+		metrics = append(metrics, result.Metrics...)
+		if result.NextToken == nil {
+			break
+		}
+		params.NextToken = result.NextToken
+	}
+
+	listMetricsResults.set(key, metrics)
+	return metrics, nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -14,47 +17,128 @@ import (
 )
 
 var (
-	listenAddress = flag.String("web.listen-address", ":9042", "Address on which to expose metrics.")
-	metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose exporter's metrics.")
-	scrapePath    = flag.String("web.telemetry-scrape-path", "/scrape", "Path under which to expose CloudWatch metrics.")
-	configFile    = flag.String("config.file", "config.yml", "Path to configuration file.")
+	listenAddress       = flag.String("web.listen-address", ":9042", "Address on which to expose metrics.")
+	metricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose exporter's metrics.")
+	scrapePath          = flag.String("web.telemetry-scrape-path", "/scrape", "Path under which to expose CloudWatch metrics.")
+	configFile          = flag.String("config.file", "config.yml", "Path to configuration file.")
+	configWatch         = flag.Bool("config.watch", false, "Reload the configuration when the configuration file changes.")
+	watchInterval       = flag.Duration("config.watch-interval", 10*time.Second, "Interval at which the configuration file is checked for changes.")
+	pollEnabled         = flag.Bool("poll.enabled", false, "Poll CloudWatch in the background and serve scrapes from memory.")
+	pollInterval        = flag.Duration("poll.interval", time.Minute, "Default interval at which tasks are polled when polling is enabled.")
+	defaultSetTimestamp = flag.Bool("cloudwatch.set-timestamp", false, "Export samples with the timestamp of their CloudWatch datapoint, unless a metric sets set_timestamp.")
+	defaultConvertUnits = flag.Bool("cloudwatch.convert-units", true, "Convert the values of metrics setting aws_unit to base units, unless a metric sets convert_unit.")
+	listMetricsTTL      = flag.Duration("cloudwatch.list-metrics-cache-ttl", 0, "How long the results of ListMetrics are cached, 0 disables the cache.")
+	maxConcurrency      = flag.Int("cloudwatch.max-concurrency", 20, "Maximum number of concurrent CloudWatch and tagging API calls across all scrapes, 0 for no limit.")
+	getMetricDataRate   = flag.Float64("cloudwatch.get-metric-data-rate", 0, "Maximum GetMetricData requests per second in each account and region, 0 for no limit.")
+	listMetricsRate     = flag.Float64("cloudwatch.list-metrics-rate", 0, "Maximum ListMetrics requests per second in each account and region, 0 for no limit.")
+	getResourcesRate    = flag.Float64("cloudwatch.get-resources-rate", 0, "Maximum tagging GetResources requests per second in each account and region, 0 for no limit.")
+	timeoutOffset       = flag.Duration("web.timeout-offset", 500*time.Millisecond, "Offset subtracted from the Prometheus scrape timeout, to leave time to send the response.")
 
 	globalRegistry *prometheus.Registry
 	settings       *config.Settings
 	totalRequests  prometheus.Counter
 	configMutex    = &sync.Mutex{}
+	// reloadMutex serializes reloads, configMutex is only held while the new tasks are swapped in
+	reloadMutex  = &sync.Mutex{}
+	pollingCache *pollCache
+
+	lastReloadSuccessful prometheus.Gauge
+	lastReloadSuccess    prometheus.Gauge
+
+	stsRequests      *prometheus.CounterVec
+	clientCacheHits  *prometheus.CounterVec
+	credentialErrors *prometheus.CounterVec
+
+	queueWait           *prometheus.HistogramVec
+	rateLimitedRequests *prometheus.CounterVec
+	throttledRequests   *prometheus.CounterVec
+	retries             *prometheus.CounterVec
 )
 
+// loadConfigFile loads and validates the configuration file, then regenerates the collector tasks.
+// On error, the current settings and tasks are kept untouched.
+// Accounts are discovered and the tasks generated before taking the configuration lock, so that scrapes aren't blocked by the AWS calls they make.
 func loadConfigFile() error {
-	var err error
-	var tmpSettings *config.Settings
-	configMutex.Lock()
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
 
 	// Initial loading of the configuration file
-	tmpSettings, err = config.Load(*configFile)
+	tmpSettings, err := config.Load(*configFile)
 	if err != nil {
+		lastReloadSuccessful.Set(0)
 		return err
 	}
 
-	generateTasks(tmpSettings)
+	err = resolveAccounts(tmpSettings)
+	if err != nil {
+		lastReloadSuccessful.Set(0)
+		return fmt.Errorf("can't discover accounts: %s", err.Error())
+	}
+
+	newTasks, err := generateTasks(tmpSettings)
+	if err != nil {
+		lastReloadSuccessful.Set(0)
+		return err
+	}
 
-	settings = tmpSettings
+	configMutex.Lock()
+	applySettings(tmpSettings, newTasks)
 	configMutex.Unlock()
 
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccess.SetToCurrentTime()
+
 	return nil
 }
 
+// applySettings makes the settings and the tasks generated from them the current ones.
+// The configuration lock must be held by the caller.
+func applySettings(newSettings *config.Settings, newTasks []*config.Task) {
+	tasks = newTasks
+
+	// Restart polling with the newly generated tasks
+	if *pollEnabled {
+		if pollingCache != nil {
+			pollingCache.close()
+		}
+		pollingCache = newPollCache(*pollInterval)
+		pollingCache.start(tasks)
+	}
+
+	currentRetryPolicy.Store(newSettings.Retry)
+	settings = newSettings
+}
+
 // handleReload handles a full reload of the configuration file and regenerates the collector tasks.
+// If the new configuration can't be loaded, the previous one stays in use.
 func handleReload(w http.ResponseWriter, req *http.Request) {
 	err := loadConfigFile()
 	if err != nil {
 		str := fmt.Sprintf("Can't read configuration file: %s", err.Error())
-		fmt.Fprintln(w, str)
-		log.Fatal(str)
+		log.Println(str)
+		http.Error(w, str, http.StatusInternalServerError)
+		return
 	}
 	fmt.Fprintln(w, "Reload complete")
 }
 
+// minScrapeTimeout bounds the scrapes whose timeout isn't longer than the timeout offset.
+const minScrapeTimeout = 100 * time.Millisecond
+
+// scrapeTimeout returns how long a scrape can last, given the scrape timeout header sent by Prometheus and the timeout offset.
+func scrapeTimeout(header string, offset time.Duration) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.Duration(seconds*float64(time.Second)) - offset
+	if timeout < minScrapeTimeout {
+		timeout = minScrapeTimeout
+	}
+	return timeout, nil
+}
+
 // handleTarget handles scrape requests which make use of CloudWatch service
 func handleTarget(w http.ResponseWriter, req *http.Request) {
 	urlQuery := req.URL.Query()
@@ -69,28 +153,42 @@ func handleTarget(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// The scrape is cancelled when the client disconnects, or just before Prometheus would give up on it
+	ctx := req.Context()
+	if header := req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		timeout, err := scrapeTimeout(header, *timeoutOffset)
+		if err != nil {
+			fmt.Printf("Failed to parse the scrape timeout header %q: %s\n", header, err)
+		} else {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
 	configMutex.Lock()
 	registry := prometheus.NewRegistry()
-	collector, err := NewCwCollector(target, task, region)
+	collector, err := NewCwCollector(ctx, target, task, region)
+	configMutex.Unlock()
 	if err != nil {
 		// Can't create the collector, display error
 		fmt.Fprintf(w, "Error: %s\n", err.Error())
-		configMutex.Unlock()
 		return
 	}
 
 	registry.MustRegister(collector)
-	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+	handler := promhttp.HandlerFor(&backfillGatherer{registry: registry, collector: collector}, promhttp.HandlerOpts{
 		DisableCompression: false,
 	})
 
 	// Serve the answer through the Collect method of the Collector
+	// The collector holds its own tasks, so a reload doesn't have to wait for the scrape
 	handler.ServeHTTP(w, req)
-	configMutex.Unlock()
 }
 
 func main() {
 	flag.Parse()
+	config.DefaultConvertUnits = *defaultConvertUnits
 
 	globalRegistry = prometheus.NewRegistry()
 
@@ -99,15 +197,85 @@ func main() {
 		Help: "API requests made to CloudWatch",
 	})
 
+	lastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cloudwatch_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cloudwatch_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+
+	stsRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudwatch_exporter_sts_requests_total",
+		Help: "AssumeRole requests made to STS, per account.",
+	}, []string{"account"})
+
+	clientCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudwatch_exporter_client_cache_hits_total",
+		Help: "Scrapes which reused a cached CloudWatch client, per account.",
+	}, []string{"account"})
+
+	credentialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudwatch_exporter_credential_errors_total",
+		Help: "Errors returned while assuming a role, per account.",
+	}, []string{"account"})
+
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "cloudwatch_exporter_api_queue_wait_seconds",
+		Help: "Time API calls waited for the rate limiter and a free worker, per API.",
+	}, []string{"api"})
+
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudwatch_exporter_rate_limited_requests_total",
+		Help: "API calls delayed by the rate limiter of their account and region, per API.",
+	}, []string{"api"})
+
+	throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudwatch_exporter_throttled_requests_total",
+		Help: "API calls throttled by AWS, per API.",
+	}, []string{"api"})
+
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudwatch_exporter_retries_total",
+		Help: "Retried AWS API calls, per API and error code.",
+	}, []string{"api", "code"})
+
 	globalRegistry.MustRegister(totalRequests)
+	globalRegistry.MustRegister(lastReloadSuccessful)
+	globalRegistry.MustRegister(lastReloadSuccess)
+	globalRegistry.MustRegister(stsRequests)
+	globalRegistry.MustRegister(clientCacheHits)
+	globalRegistry.MustRegister(credentialErrors)
+	globalRegistry.MustRegister(queueWait)
+	globalRegistry.MustRegister(rateLimitedRequests)
+	globalRegistry.MustRegister(throttledRequests)
+	globalRegistry.MustRegister(retries)
 
 	prometheus.DefaultGatherer = globalRegistry
 
+	listMetricsResults = newListMetricsCache(*listMetricsTTL)
+	limiter = newAPILimiter(*maxConcurrency, map[string]float64{
+		apiGetMetricData: *getMetricDataRate,
+		apiListMetrics:   *listMetricsRate,
+		apiGetResources:  *getResourcesRate,
+	})
+
 	err := loadConfigFile()
 	if err != nil {
 		log.Fatalf("Can't read configuration file: %s\n", err.Error())
 	}
 
+	// Allows reloading the configuration through SIGHUP and, optionally, when the file changes
+	go watchSignals()
+
+	// Keeps the accounts discovered from AWS Organizations up to date
+	go refreshAccounts()
+	if *configWatch {
+		go watchConfigFile(*configFile, *watchInterval)
+	}
+
 	fmt.Println("CloudWatch exporter started...")
 
 	// Expose the exporter's own metrics on /metrics
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected time.Duration
+		err      bool
+	}{
+		{header: "10", expected: 9500 * time.Millisecond},
+		{header: "1.5", expected: time.Second},
+		{header: "0.5", expected: minScrapeTimeout},
+		{header: "0.55", expected: minScrapeTimeout},
+		{header: "-1", expected: minScrapeTimeout},
+		{header: "ten", err: true},
+	}
+
+	for _, test := range tests {
+		timeout, err := scrapeTimeout(test.header, 500*time.Millisecond)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.header, timeout)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.header, err)
+		} else if timeout != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.header, test.expected, timeout)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// listAccountsForParent returns the accounts in an organizational unit and all the units nested in it.
+func listAccountsForParent(svc *organizations.Organizations, parentID string) ([]*organizations.Account, error) {
+	var accounts []*organizations.Account
+
+	err := svc.ListAccountsForParentPages(&organizations.ListAccountsForParentInput{
+		ParentId: aws.String(parentID),
+	}, func(page *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+		accounts = append(accounts, page.Accounts...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*organizations.OrganizationalUnit
+	err = svc.ListOrganizationalUnitsForParentPages(&organizations.ListOrganizationalUnitsForParentInput{
+		ParentId: aws.String(parentID),
+	}, func(page *organizations.ListOrganizationalUnitsForParentOutput, lastPage bool) bool {
+		children = append(children, page.OrganizationalUnits...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		childAccounts, err := listAccountsForParent(svc, aws.StringValue(child.Id))
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, childAccounts...)
+	}
+
+	return accounts, nil
+}
+
+// hasTags returns true if the account has all the given tags with the given values.
+func hasTags(svc *organizations.Organizations, account *organizations.Account, tags map[string]string) (bool, error) {
+	accountTags := map[string]string{}
+
+	err := svc.ListTagsForResourcePages(&organizations.ListTagsForResourceInput{
+		ResourceId: account.Id,
+	}, func(page *organizations.ListTagsForResourceOutput, lastPage bool) bool {
+		for _, tag := range page.Tags {
+			accountTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for key, value := range tags {
+		if accountValue, ok := accountTags[key]; !ok || accountValue != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// discoverAccounts lists the accounts of the organization which match the filters of the discovery settings.
+func discoverAccounts(discovery *config.AccountsDiscovery) ([]*organizations.Account, error) {
+	svc := clients.getOrganizations(discovery.Account, discovery.RoleName, discovery.Endpoint)
+
+	var listed []*organizations.Account
+	if len(discovery.OrganizationalUnits) == 0 {
+		err := svc.ListAccountsPages(&organizations.ListAccountsInput{}, func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+			listed = append(listed, page.Accounts...)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, unit := range discovery.OrganizationalUnits {
+			unitAccounts, err := listAccountsForParent(svc, unit)
+			if err != nil {
+				return nil, err
+			}
+			listed = append(listed, unitAccounts...)
+		}
+	}
+
+	accounts := []*organizations.Account{}
+	seen := map[string]bool{}
+	for _, account := range listed {
+		id := aws.StringValue(account.Id)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if discovery.Status != "" && !strings.EqualFold(aws.StringValue(account.Status), discovery.Status) {
+			continue
+		}
+
+		if len(discovery.Tags) > 0 {
+			match, err := hasTags(svc, account, discovery.Tags)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+// resolveAccounts replaces the accounts of the settings by the ones discovered in the organization, named after their account name.
+// Settings without accounts_discovery keep their accounts, only the unnamed ones are named, see resolveAccountNames.
+func resolveAccounts(cfg *config.Settings) error {
+	if cfg.AccountsDiscovery == nil {
+		resolveAccountNames(cfg)
+		return nil
+	}
+
+	accounts, err := discoverAccounts(cfg.AccountsDiscovery)
+	if err != nil {
+		return err
+	}
+
+	cfg.Accounts = []config.Account{}
+	for _, account := range accounts {
+		cfg.Accounts = append(cfg.Accounts, config.Account{
+			ID:   aws.StringValue(account.Id),
+			Name: aws.StringValue(account.Name),
+		})
+	}
+	return nil
+}
+
+// resolveAccountNames names the listed accounts which have no name after their Organizations account name.
+// Organizations access is optional: if the accounts can't be listed with the default credentials, the account IDs are used as names.
+func resolveAccountNames(cfg *config.Settings) {
+	unnamed := false
+	for _, account := range cfg.Accounts {
+		if account.Name == "" {
+			unnamed = true
+		}
+	}
+	if !unnamed {
+		return
+	}
+
+	accounts, err := discoverAccounts(&config.AccountsDiscovery{})
+	if err != nil {
+		log.Printf("Can't resolve the account names from Organizations, account IDs are used instead: %s\n", err.Error())
+		return
+	}
+
+	names := map[string]string{}
+	for _, account := range accounts {
+		names[aws.StringValue(account.Id)] = aws.StringValue(account.Name)
+	}
+	for i := range cfg.Accounts {
+		if cfg.Accounts[i].Name == "" {
+			cfg.Accounts[i].Name = names[cfg.Accounts[i].ID]
+		}
+	}
+}
+
+// refreshAccounts periodically discovers the accounts again and regenerates the tasks when they changed.
+func refreshAccounts() {
+	for {
+		interval := config.DefaultDiscoveryRefreshSeconds
+		configMutex.Lock()
+		current := settings
+		configMutex.Unlock()
+		if current != nil && current.AccountsDiscovery != nil {
+			interval = current.AccountsDiscovery.RefreshIntervalSeconds
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		configMutex.Lock()
+		current = settings
+		configMutex.Unlock()
+		if current == nil || current.AccountsDiscovery == nil {
+			continue
+		}
+
+		// Discovery and task generation can be slow, don't block scrapes while they run
+		refreshed := *current
+		err := resolveAccounts(&refreshed)
+		if err != nil {
+			log.Printf("Can't refresh the discovered accounts: %s\n", err.Error())
+			continue
+		}
+		if reflect.DeepEqual(refreshed.Accounts, current.Accounts) {
+			continue
+		}
+		newTasks, err := generateTasks(&refreshed)
+		if err != nil {
+			log.Printf("Can't apply the discovered accounts: %s\n", err.Error())
+			continue
+		}
+
+		configMutex.Lock()
+		// Skip the refresh if the configuration was reloaded in the meantime
+		if settings == current {
+			applySettings(&refreshed, newTasks)
+			log.Printf("Discovered accounts changed, %d accounts are now scraped\n", len(refreshed.Accounts))
+		}
+		configMutex.Unlock()
+	}
+}
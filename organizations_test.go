@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// setTestCredentials sets static credentials in the environment, so that the default credentials chain doesn't look for real ones.
+// It returns the function restoring the environment.
+func setTestCredentials() func() {
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":         "test",
+		"AWS_SECRET_ACCESS_KEY":     "test",
+		"AWS_EC2_METADATA_DISABLED": "true",
+	}
+
+	previous := map[string]*string{}
+	for name, value := range env {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// fakeAccount is an account of the fake organization.
+type fakeAccount struct {
+	ID     string `json:"Id"`
+	Name   string
+	Status string
+	tags   map[string]string
+}
+
+// fakeOrganization serves the Organizations calls made by discoverAccounts.
+//
+//	r-root: 111, ou-a, ou-b
+//	ou-a:   222, 333, ou-c
+//	ou-c:   444
+//	ou-b:   111
+type fakeOrganization struct {
+	accounts map[string]*fakeAccount
+	parents  map[string][]string
+	units    map[string][]string
+}
+
+func newFakeOrganization() *fakeOrganization {
+	return &fakeOrganization{
+		accounts: map[string]*fakeAccount{
+			"111": {ID: "111", Name: "production", Status: "ACTIVE", tags: map[string]string{"env": "prod"}},
+			"222": {ID: "222", Name: "staging", Status: "ACTIVE", tags: map[string]string{"env": "staging"}},
+			"333": {ID: "333", Name: "closed", Status: "SUSPENDED", tags: map[string]string{"env": "prod"}},
+			"444": {ID: "444", Name: "nested", Status: "ACTIVE", tags: map[string]string{"env": "prod", "team": "data"}},
+		},
+		parents: map[string][]string{
+			"r-root": {"111"},
+			"ou-a":   {"222", "333"},
+			"ou-c":   {"444"},
+			"ou-b":   {"111"},
+		},
+		units: map[string][]string{
+			"r-root": {"ou-a", "ou-b"},
+			"ou-a":   {"ou-c"},
+		},
+	}
+}
+
+// fakePage returns the items of a page, one item per page so that pagination is exercised.
+func fakePage(items []interface{}, token string) ([]interface{}, string) {
+	start := 0
+	if token != "" {
+		start = len(token)
+	}
+	if start >= len(items) {
+		return []interface{}{}, ""
+	}
+	next := ""
+	if start+1 < len(items) {
+		next = strings.Repeat("n", start+1)
+	}
+	return items[start : start+1], next
+}
+
+func (org *fakeOrganization) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var input struct {
+		ParentId   string
+		ResourceId string
+		NextToken  string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	output := map[string]interface{}{}
+	var items []interface{}
+	var key string
+
+	switch strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "AWSOrganizationsV20161128.") {
+	case "ListAccounts":
+		ids := []string{}
+		for id := range org.accounts {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			items = append(items, org.accounts[id])
+		}
+		key = "Accounts"
+	case "ListAccountsForParent":
+		for _, id := range org.parents[input.ParentId] {
+			items = append(items, org.accounts[id])
+		}
+		key = "Accounts"
+	case "ListOrganizationalUnitsForParent":
+		for _, id := range org.units[input.ParentId] {
+			items = append(items, map[string]string{"Id": id})
+		}
+		key = "OrganizationalUnits"
+	case "ListTagsForResource":
+		tags := org.accounts[input.ResourceId].tags
+		keys := []string{}
+		for tagKey := range tags {
+			keys = append(keys, tagKey)
+		}
+		sort.Strings(keys)
+		for _, tagKey := range keys {
+			items = append(items, map[string]string{"Key": tagKey, "Value": tags[tagKey]})
+		}
+		key = "Tags"
+	default:
+		http.Error(w, "unknown operation", http.StatusBadRequest)
+		return
+	}
+
+	output[key], output["NextToken"] = fakePage(items, input.NextToken)
+	if output["NextToken"] == "" {
+		delete(output, "NextToken")
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(output)
+}
+
+func TestDiscoverAccounts(t *testing.T) {
+	defer setTestCredentials()()
+	clients = newClientCache()
+
+	server := httptest.NewServer(newFakeOrganization())
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		discovery config.AccountsDiscovery
+		expected  []string
+	}{
+		{
+			name:     "whole organization",
+			expected: []string{"111", "222", "333", "444"},
+		},
+		{
+			name:      "nested organizational units",
+			discovery: config.AccountsDiscovery{OrganizationalUnits: []string{"ou-a"}},
+			expected:  []string{"222", "333", "444"},
+		},
+		{
+			name:      "accounts listed twice",
+			discovery: config.AccountsDiscovery{OrganizationalUnits: []string{"r-root", "ou-c"}},
+			expected:  []string{"111", "222", "333", "444"},
+		},
+		{
+			name:      "status",
+			discovery: config.AccountsDiscovery{OrganizationalUnits: []string{"r-root"}, Status: "active"},
+			expected:  []string{"111", "222", "444"},
+		},
+		{
+			name:      "tags",
+			discovery: config.AccountsDiscovery{Tags: map[string]string{"env": "prod"}},
+			expected:  []string{"111", "333", "444"},
+		},
+		{
+			name:      "status and tags",
+			discovery: config.AccountsDiscovery{Status: "ACTIVE", Tags: map[string]string{"env": "prod", "team": "data"}},
+			expected:  []string{"444"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			discovery := test.discovery
+			discovery.Endpoint = server.URL
+
+			accounts, err := discoverAccounts(&discovery)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			ids := []string{}
+			for _, account := range accounts {
+				ids = append(ids, aws.StringValue(account.Id))
+			}
+			sort.Strings(ids)
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("expected accounts %v, got %v", test.expected, ids)
+			}
+		})
+	}
+}
+
+func TestResolveAccounts(t *testing.T) {
+	defer setTestCredentials()()
+	clients = newClientCache()
+
+	server := httptest.NewServer(newFakeOrganization())
+	defer server.Close()
+
+	cfg := &config.Settings{
+		AccountsDiscovery: &config.AccountsDiscovery{Endpoint: server.URL, Status: "ACTIVE"},
+	}
+	if err := resolveAccounts(cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []config.Account{
+		{ID: "111", Name: "production"},
+		{ID: "222", Name: "staging"},
+		{ID: "444", Name: "nested"},
+	}
+	sort.Slice(cfg.Accounts, func(i, j int) bool { return cfg.Accounts[i].ID < cfg.Accounts[j].ID })
+	if !reflect.DeepEqual(cfg.Accounts, expected) {
+		t.Errorf("expected accounts %v, got %v", expected, cfg.Accounts)
+	}
+}
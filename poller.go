@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// cacheAgeDesc describes the age of the cached samples served for a task.
+var cacheAgeDesc = prometheus.NewDesc(
+	"cloudwatch_exporter_cache_age_seconds",
+	"Time since the cached CloudWatch samples of this task were polled, in seconds.",
+	[]string{"task", "region", "account"},
+	nil)
+
+// targetIdleIntervals is the number of poll intervals after which a task polled for a target which isn't requested anymore stops being polled.
+const targetIdleIntervals = 10
+
+// pollKey identifies a generated task polled for a given target.
+type pollKey struct {
+	task    string
+	account string
+	region  string
+	target  string
+}
+
+// pollEntry holds the result of the last poll of a task for a given target.
+type pollEntry struct {
+	task   *config.Task
+	target string
+
+	// ready is closed once the first poll completed
+	ready chan struct{}
+	// requested is the last time the entry was requested, guarded by the cache mutex
+	requested time.Time
+
+	mutex     sync.RWMutex
+	metrics   []prometheus.Metric
+	backfill  []backfillSample
+	erroneous float64
+	updated   time.Time
+}
+
+// pollCache polls every generated task in the background and keeps the latest results in memory.
+type pollCache struct {
+	interval time.Duration
+	mutex    sync.Mutex
+	entries  map[pollKey]*pollEntry
+
+	// ctx is done once the cache is closed, the polls in progress are then cancelled
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newPollCache(interval time.Duration) *pollCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pollCache{
+		interval: interval,
+		entries:  map[pollKey]*pollEntry{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// usesTarget returns true if the task needs a $_target value to be scraped.
+func usesTarget(task *config.Task) bool {
+	for _, metric := range task.Metrics {
+		for _, values := range metric.DimensionsSelect {
+			for _, value := range values {
+				if value == "$_target" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// start begins polling every task which can be scraped without a target.
+// Tasks relying on $_target are added lazily when they are first requested.
+func (cache *pollCache) start(tasks []*config.Task) {
+	for _, task := range tasks {
+		if !usesTarget(task) {
+			cache.entry(task, "")
+		}
+	}
+}
+
+// close stops all the pollers of the cache and cancels the polls in progress.
+func (cache *pollCache) close() {
+	cache.cancel()
+}
+
+// entry returns the cache entry for a task and target, starting a new poller if it doesn't exist yet.
+func (cache *pollCache) entry(task *config.Task, target string) *pollEntry {
+	key := pollKey{
+		task:    task.Name,
+		account: task.Account,
+		region:  task.Region,
+		target:  target,
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if entry, ok := cache.entries[key]; ok {
+		entry.requested = time.Now()
+		return entry
+	}
+
+	entry := &pollEntry{
+		task:      task,
+		target:    target,
+		ready:     make(chan struct{}),
+		requested: time.Now(),
+	}
+	cache.entries[key] = entry
+
+	interval := cache.interval
+	if task.PollIntervalSeconds > 0 {
+		interval = time.Duration(task.PollIntervalSeconds) * time.Second
+	}
+	go cache.poll(key, entry, interval)
+
+	return entry
+}
+
+// poll refreshes the entry on every interval until the cache is closed, or until the entry is evicted.
+func (cache *pollCache) poll(key pollKey, entry *pollEntry, interval time.Duration) {
+	entry.refresh(cache.ctx, interval)
+	close(entry.ready)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cache.ctx.Done():
+			return
+		case <-ticker.C:
+			if cache.evictIdle(key, entry, interval) {
+				return
+			}
+			entry.refresh(cache.ctx, interval)
+		}
+	}
+}
+
+// evictIdle removes an entry polled for a target if it wasn't requested for targetIdleIntervals intervals.
+// Targets come and go with service discovery, their pollers would otherwise keep calling CloudWatch until the next reload.
+// It returns true if the entry was evicted, it's polled again from scratch if the target is requested later.
+func (cache *pollCache) evictIdle(key pollKey, entry *pollEntry, interval time.Duration) bool {
+	if entry.target == "" {
+		return false
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if time.Since(entry.requested) < targetIdleIntervals*interval {
+		return false
+	}
+	delete(cache.entries, key)
+	return true
+}
+
+// refresh scrapes the task from CloudWatch and replaces the cached metrics.
+// A poll is given an interval to complete, so that a hung call can't hold its poller and limiter worker forever.
+// The series scraped until then are kept, like for a scrape reaching its deadline.
+func (entry *pollEntry) refresh(ctx context.Context, timeout time.Duration) {
+	collector := &Collector{
+		Target: entry.target,
+		ErroneousRequests: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cloudwatch_exporter_erroneous_requests",
+			Help: "The number of erroneous request made by this scrape.",
+		}),
+		Tasks: []*config.Task{entry.task},
+	}
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	metrics := []prometheus.Metric{}
+	go func() {
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		close(done)
+	}()
+
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	scrape(pollCtx, collector, ch)
+	cancel()
+	close(ch)
+	<-done
+
+	erroneous := &dto.Metric{}
+	collector.ErroneousRequests.Write(erroneous)
+
+	entry.mutex.Lock()
+	entry.metrics = metrics
+	entry.backfill = collector.backfill
+	entry.erroneous = erroneous.GetGauge().GetValue()
+	entry.updated = time.Now()
+	entry.mutex.Unlock()
+}
+
+// collect sends the cached metrics of the entry and their age, and hands its backfill samples to the collector.
+// It returns the number of erroneous requests made by the last poll, nothing is sent if the scrape is done before the first poll completed.
+func (entry *pollEntry) collect(collector *Collector, ch chan<- prometheus.Metric) float64 {
+	select {
+	case <-entry.ready:
+	case <-collector.ctx.Done():
+		return 0
+	}
+
+	entry.mutex.RLock()
+	defer entry.mutex.RUnlock()
+
+	for _, metric := range entry.metrics {
+		ch <- metric
+	}
+	for _, sample := range entry.backfill {
+		collector.addBackfill(sample.name, sample.metric)
+	}
+
+	ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, time.Since(entry.updated).Seconds(),
+		entry.task.Name, entry.task.Region, accountLabel(entry.task.Account))
+
+	return entry.erroneous
+}
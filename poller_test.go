@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+func TestPollCacheEntry(t *testing.T) {
+	// The client metrics are created by main
+	clientCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "client_cache_hits_total", Help: "Client cache hits"}, []string{"account"})
+
+	cache := newPollCache(time.Hour)
+	defer cache.close()
+
+	// The task has no metric, so its polls don't call CloudWatch
+	task := &config.Task{Name: "ec2", Region: "eu-west-1"}
+	entry := cache.entry(task, "a")
+	if again := cache.entry(task, "a"); again != entry {
+		t.Error("expected the entry of a task and target to be reused")
+	}
+	if other := cache.entry(task, "b"); other == entry {
+		t.Error("expected another target to get its own entry")
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(cache.entries))
+	}
+
+	select {
+	case <-entry.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first poll to complete")
+	}
+}
+
+func TestPollCacheEvictIdle(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		idle      time.Duration
+		evicted   bool
+		remaining int
+	}{
+		{name: "task without target", idle: time.Hour, remaining: 1},
+		{name: "target requested recently", target: "a", idle: 9 * time.Minute, remaining: 1},
+		{name: "idle target", target: "a", idle: 10 * time.Minute, evicted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := newPollCache(time.Minute)
+			defer cache.close()
+
+			key := pollKey{task: "ec2", region: "eu-west-1", target: test.target}
+			entry := &pollEntry{target: test.target, requested: time.Now().Add(-test.idle)}
+			cache.entries[key] = entry
+
+			if evicted := cache.evictIdle(key, entry, time.Minute); evicted != test.evicted {
+				t.Errorf("expected evicted to be %t, got %t", test.evicted, evicted)
+			}
+			if len(cache.entries) != test.remaining {
+				t.Errorf("expected %d entries, got %d", test.remaining, len(cache.entries))
+			}
+		})
+	}
+}
+
+func TestPollEntryCollect(t *testing.T) {
+	desc := prometheus.NewDesc("aws_ec2_cpu_utilization", "AWS/EC2 CPUUtilization", nil, nil)
+	task := &config.Task{Name: "ec2", Region: "eu-west-1"}
+
+	t.Run("cached result", func(t *testing.T) {
+		entry := &pollEntry{
+			task:      task,
+			ready:     make(chan struct{}),
+			metrics:   []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 42)},
+			erroneous: 2,
+			updated:   time.Now(),
+		}
+		close(entry.ready)
+
+		ch := make(chan prometheus.Metric, 10)
+		if erroneous := entry.collect(&Collector{ctx: context.Background()}, ch); erroneous != 2 {
+			t.Errorf("expected 2 erroneous requests, got %g", erroneous)
+		}
+		close(ch)
+
+		// The cached sample is followed by the age of the cache
+		var metrics []prometheus.Metric
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		if len(metrics) != 2 || metrics[0] != entry.metrics[0] || metrics[1].Desc() != cacheAgeDesc {
+			t.Errorf("expected the cached sample and the cache age, got %v", metrics)
+		}
+	})
+
+	t.Run("scrape done before the first poll", func(t *testing.T) {
+		entry := &pollEntry{task: task, ready: make(chan struct{})}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ch := make(chan prometheus.Metric, 10)
+		if erroneous := entry.collect(&Collector{ctx: ctx}, ch); erroneous != 0 {
+			t.Errorf("expected no erroneous request, got %g", erroneous)
+		}
+		if len(ch) != 0 {
+			t.Errorf("expected nothing to be sent, got %d metrics", len(ch))
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// defaultRegions are the regions enabled by default in every account.
+// They are used in place of "all" when the list of regions can't be requested from AWS.
+var defaultRegions = []string{
+	"ap-northeast-1",
+	"ap-northeast-2",
+	"ap-northeast-3",
+	"ap-south-1",
+	"ap-southeast-1",
+	"ap-southeast-2",
+	"ca-central-1",
+	"eu-central-1",
+	"eu-north-1",
+	"eu-west-1",
+	"eu-west-2",
+	"eu-west-3",
+	"sa-east-1",
+	"us-east-1",
+	"us-east-2",
+	"us-west-1",
+	"us-west-2",
+}
+
+// getAllRegions returns the regions enabled for the default credentials, or the default regions if they can't be listed.
+func getAllRegions() []string {
+	svc := clients.getEC2("", "", "us-east-1")
+	result, err := svc.DescribeRegions(&ec2.DescribeRegionsInput{})
+	if err != nil {
+		log.Printf("Can't list AWS regions, using the default regions instead: %s\n", err.Error())
+		return defaultRegions
+	}
+
+	regionList := []string{}
+	for _, region := range result.Regions {
+		regionList = append(regionList, *region.RegionName)
+	}
+
+	return regionList
+}
+
+// regionResolver expands the regions of tasks for a given configuration.
+type regionResolver struct {
+	cfg        *config.Settings
+	allRegions []string
+}
+
+func newRegionResolver(cfg *config.Settings) *regionResolver {
+	return &regionResolver{cfg: cfg}
+}
+
+// all returns every region, requesting them from AWS the first time only.
+func (resolver *regionResolver) all() []string {
+	if resolver.allRegions == nil {
+		resolver.allRegions = getAllRegions()
+	}
+	return resolver.allRegions
+}
+
+// taskRegions returns the regions a task is scraped in, without the regions excluded at the top level or by the task.
+func (resolver *regionResolver) taskRegions(task config.Task) []string {
+	requested := task.Regions
+	if len(requested) == 0 {
+		requested = []string{task.Region}
+	}
+
+	regions := []string{}
+	seen := map[string]bool{}
+	for _, region := range requested {
+		expanded := []string{region}
+		if strings.EqualFold(region, "all") {
+			expanded = resolver.all()
+		}
+
+		for _, region := range expanded {
+			if seen[region] || resolver.excluded(task, region) {
+				continue
+			}
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+
+	return regions
+}
+
+// excluded returns true if the region is in the top level or the task exclude_regions.
+func (resolver *regionResolver) excluded(task config.Task, region string) bool {
+	for _, excludeRegion := range append(append([]string{}, resolver.cfg.ExcludeRegions...), task.ExcludeRegions...) {
+		if strings.EqualFold(region, excludeRegion) {
+			return true
+		}
+	}
+	return false
+}
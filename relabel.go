@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// relabelledDescs caches the descriptors of relabelled series by name, help and label names, so they're only built once.
+var relabelledDescs sync.Map
+
+// outputSeries is the descriptor and label values a query is exported with.
+type outputSeries struct {
+	name   string
+	desc   *prometheus.Desc
+	labels []string
+}
+
+// querySeries returns the series of a query once its metric relabel configs are applied.
+// It returns false when the series is dropped by a rule.
+func querySeries(query *dataQuery) (outputSeries, bool) {
+	configMetric := query.metric
+	if len(configMetric.Relabel) == 0 {
+		return outputSeries{name: query.name, desc: query.desc, labels: query.labels}, true
+	}
+
+	// The metric name is exposed as __name__ and static labels as regular labels, so rules can change them too
+	labels := map[string]string{"__name__": query.name}
+	for name, value := range configMetric.Labels {
+		labels[name] = value
+	}
+	for i, name := range configMetric.LabelNames {
+		labels[name] = query.labels[i]
+	}
+
+	labels = relabel(labels, configMetric.Relabel)
+	if labels == nil {
+		return outputSeries{}, false
+	}
+
+	// A series renamed to an invalid name can't be exported
+	name := labels["__name__"]
+	if !config.MetricNameRegex.MatchString(name) {
+		return outputSeries{}, false
+	}
+
+	// Labels starting with __ are internal, and empty labels are the same as missing ones
+	names := []string{}
+	for label, value := range labels {
+		if config.LabelNameRegex.MatchString(label) && !strings.HasPrefix(label, "__") && value != "" {
+			names = append(names, label)
+		}
+	}
+	sort.Strings(names)
+
+	values := make([]string, len(names))
+	for i, label := range names {
+		values[i] = labels[label]
+	}
+
+	// The help is the same as for the series that aren't relabelled
+	_, help, _ := configMetric.ExportedStatistic("", query.statistic)
+
+	key := strings.Join(append([]string{name, help}, names...), "\xff")
+	desc, ok := relabelledDescs.Load(key)
+	if !ok {
+		desc, _ = relabelledDescs.LoadOrStore(key, prometheus.NewDesc(name, help, names, nil))
+	}
+
+	return outputSeries{name: name, desc: desc.(*prometheus.Desc), labels: values}, true
+}
+
+// relabel applies the relabel configs in order to a set of labels.
+// It returns nil when the series is dropped.
+func relabel(labels map[string]string, relabelConfigs []*config.RelabelConfig) map[string]string {
+	for _, cfg := range relabelConfigs {
+		values := make([]string, 0, len(cfg.SourceLabels))
+		for _, name := range cfg.SourceLabels {
+			values = append(values, labels[name])
+		}
+		value := strings.Join(values, cfg.Separator)
+
+		switch cfg.Action {
+		case config.RelabelDrop:
+			if cfg.Regexp.MatchString(value) {
+				return nil
+			}
+		case config.RelabelKeep:
+			if !cfg.Regexp.MatchString(value) {
+				return nil
+			}
+		case config.RelabelReplace:
+			indexes := cfg.Regexp.FindStringSubmatchIndex(value)
+			// The rule doesn't apply if the regex doesn't match
+			if indexes == nil {
+				break
+			}
+			target := string(cfg.Regexp.ExpandString([]byte{}, cfg.TargetLabel, value, indexes))
+			// Like in Prometheus, an invalid target or an empty replacement removes the target label
+			if !config.LabelNameRegex.MatchString(target) {
+				delete(labels, cfg.TargetLabel)
+				break
+			}
+			replacement := string(cfg.Regexp.ExpandString([]byte{}, cfg.Replacement, value, indexes))
+			if len(replacement) == 0 {
+				delete(labels, cfg.TargetLabel)
+				break
+			}
+			labels[target] = replacement
+		case config.RelabelHashMod:
+			sum := md5.Sum([]byte(value))
+			labels[cfg.TargetLabel] = fmt.Sprintf("%d", binary.BigEndian.Uint64(sum[8:])%cfg.Modulus)
+		case config.RelabelLabelMap:
+			mapped := map[string]string{}
+			for name, value := range labels {
+				if cfg.Regexp.MatchString(name) {
+					mapped[cfg.Regexp.ReplaceAllString(name, cfg.Replacement)] = value
+				}
+			}
+			for name, value := range mapped {
+				labels[name] = value
+			}
+		case config.RelabelLabelDrop:
+			for name := range labels {
+				if name != "__name__" && cfg.Regexp.MatchString(name) {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+
+	return labels
+}
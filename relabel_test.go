@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// relabelConfig returns a rule with the default values, changed by the given function, and its regex compiled.
+func relabelConfig(change func(*config.RelabelConfig)) *config.RelabelConfig {
+	cfg := config.DefaultRelabelConfig
+	change(&cfg)
+	cfg.Regexp = regexp.MustCompile(fmt.Sprintf("^(?:%s)$", cfg.Regex))
+	return &cfg
+}
+
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		configs  []*config.RelabelConfig
+		expected map[string]string
+	}{
+		{
+			name:   "default replace copies the source labels",
+			labels: map[string]string{"function_name": "prod-api"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"function_name"}
+				cfg.TargetLabel = "function"
+			})},
+			expected: map[string]string{"function_name": "prod-api", "function": "prod-api"},
+		},
+		{
+			name:   "replace with capture groups and a separator",
+			labels: map[string]string{"env": "prod", "instance_id": "i-1"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env", "instance_id"}
+				cfg.Regex = "(.*);i-(.*)"
+				cfg.TargetLabel = "${1}_instance"
+				cfg.Replacement = "$2"
+			})},
+			expected: map[string]string{"env": "prod", "instance_id": "i-1", "prod_instance": "1"},
+		},
+		{
+			name:   "replace is anchored",
+			labels: map[string]string{"function_name": "prod-api"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"function_name"}
+				cfg.Regex = "prod"
+				cfg.TargetLabel = "env"
+			})},
+			expected: map[string]string{"function_name": "prod-api"},
+		},
+		{
+			name:   "empty replacement removes the target label",
+			labels: map[string]string{"task": "lambda", "env": "prod"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"task"}
+				cfg.TargetLabel = "env"
+				cfg.Replacement = ""
+			})},
+			expected: map[string]string{"task": "lambda"},
+		},
+		{
+			name:   "missing source labels are empty",
+			labels: map[string]string{"env": "prod"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"missing"}
+				cfg.TargetLabel = "env"
+			})},
+			expected: map[string]string{},
+		},
+		{
+			name:   "invalid target label",
+			labels: map[string]string{"env": "prod"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env"}
+				cfg.TargetLabel = "${1}-env"
+			})},
+			expected: map[string]string{"env": "prod"},
+		},
+		{
+			name:   "rules are applied in order",
+			labels: map[string]string{"function_name": "prod-api"},
+			configs: []*config.RelabelConfig{
+				relabelConfig(func(cfg *config.RelabelConfig) {
+					cfg.SourceLabels = []string{"function_name"}
+					cfg.TargetLabel = "function"
+				}),
+				relabelConfig(func(cfg *config.RelabelConfig) {
+					cfg.SourceLabels = []string{"function"}
+					cfg.Regex = "(prod|staging)-.*"
+					cfg.TargetLabel = "env"
+				}),
+			},
+			expected: map[string]string{"function_name": "prod-api", "function": "prod-api", "env": "prod"},
+		},
+		{
+			name:   "keep matching series",
+			labels: map[string]string{"env": "prod"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env"}
+				cfg.Regex = "prod|staging"
+				cfg.Action = config.RelabelKeep
+			})},
+			expected: map[string]string{"env": "prod"},
+		},
+		{
+			name:   "keep drops other series",
+			labels: map[string]string{"env": "dev"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env"}
+				cfg.Regex = "prod|staging"
+				cfg.Action = config.RelabelKeep
+			})},
+		},
+		{
+			name:   "drop matching series",
+			labels: map[string]string{"env": "dev"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env"}
+				cfg.Regex = "dev"
+				cfg.Action = config.RelabelDrop
+			})},
+		},
+		{
+			name:   "drop keeps other series",
+			labels: map[string]string{"env": "prod"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env"}
+				cfg.Regex = "dev"
+				cfg.Action = config.RelabelDrop
+			})},
+			expected: map[string]string{"env": "prod"},
+		},
+		{
+			name:   "labelmap",
+			labels: map[string]string{"tag_env": "prod", "tag_team": "data", "task": "ec2"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.Regex = "tag_(.+)"
+				cfg.Action = config.RelabelLabelMap
+			})},
+			expected: map[string]string{"tag_env": "prod", "tag_team": "data", "task": "ec2", "env": "prod", "team": "data"},
+		},
+		{
+			name:   "labeldrop",
+			labels: map[string]string{"__name__": "aws_ec2_cpu", "function_name": "api", "task": "lambda", "region": "eu-west-1"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.Regex = "function_name|task|__name__"
+				cfg.Action = config.RelabelLabelDrop
+			})},
+			expected: map[string]string{"__name__": "aws_ec2_cpu", "region": "eu-west-1"},
+		},
+		{
+			name:   "hashmod",
+			labels: map[string]string{"env": "prod", "instance_id": "i-1"},
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env", "instance_id"}
+				cfg.Modulus = 10
+				cfg.TargetLabel = "shard"
+				cfg.Action = config.RelabelHashMod
+			})},
+			expected: map[string]string{"env": "prod", "instance_id": "i-1", "shard": "5"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labels := relabel(test.labels, test.configs)
+			if !reflect.DeepEqual(labels, test.expected) {
+				t.Errorf("expected labels %v, got %v", test.expected, labels)
+			}
+		})
+	}
+}
+
+func TestQuerySeries(t *testing.T) {
+	tests := []struct {
+		name     string
+		configs  []*config.RelabelConfig
+		mode     string
+		expected *outputSeries
+		help     string
+	}{
+		{
+			name: "renamed series",
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"__name__"}
+				cfg.Regex = "aws_(.*)"
+				cfg.TargetLabel = "__name__"
+			})},
+			expected: &outputSeries{name: "ec2_cpu", labels: []string{"prod", "i-1", "ec2"}},
+			help:     "AWS/EC2 CPUUtilization",
+		},
+		{
+			name: "suffix mode help names the statistic",
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"__name__"}
+				cfg.Regex = "aws_(.*)"
+				cfg.TargetLabel = "__name__"
+			})},
+			mode:     config.StatisticSuffix,
+			expected: &outputSeries{name: "ec2_cpu", labels: []string{"prod", "i-1", "ec2"}},
+			help:     "AWS/EC2 CPUUtilization Average",
+		},
+		{
+			name: "internal labels are removed",
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env"}
+				cfg.TargetLabel = "__tmp"
+			})},
+			expected: &outputSeries{name: "aws_ec2_cpu", labels: []string{"prod", "i-1", "ec2"}},
+		},
+		{
+			name: "invalid metric name",
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"instance_id"}
+				cfg.TargetLabel = "__name__"
+			})},
+		},
+		{
+			name: "dropped series",
+			configs: []*config.RelabelConfig{relabelConfig(func(cfg *config.RelabelConfig) {
+				cfg.SourceLabels = []string{"env"}
+				cfg.Regex = "prod"
+				cfg.Action = config.RelabelDrop
+			})},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := &dataQuery{
+				metric: &config.Metric{
+					Namespace:     "AWS/EC2",
+					Name:          "CPUUtilization",
+					StatisticMode: test.mode,
+					Labels:        map[string]string{"env": "prod"},
+					LabelNames:    []string{"instance_id", "task"},
+					Relabel:       test.configs,
+				},
+				labels:    []string{"i-1", "ec2"},
+				statistic: "Average",
+				name:      "aws_ec2_cpu",
+			}
+
+			series, ok := querySeries(query)
+			if test.expected == nil {
+				if ok {
+					t.Errorf("expected the series to be dropped, got %v", series)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("expected a series, got none")
+			}
+			if series.name != test.expected.name || !reflect.DeepEqual(series.labels, test.expected.labels) {
+				t.Errorf("expected series %s%v, got %s%v", test.expected.name, test.expected.labels, series.name, series.labels)
+			}
+			if test.help != "" && !strings.Contains(series.desc.String(), fmt.Sprintf("help: %q", test.help)) {
+				t.Errorf("expected help %q, got %s", test.help, series.desc)
+			}
+		})
+	}
+}
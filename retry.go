@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// currentRetryPolicy holds the retry policy of the current settings.
+// It's read by every failed call, without the configuration lock which is held while discovering accounts.
+var currentRetryPolicy atomic.Value
+
+// retryPolicy returns the retry policy of the current settings, or the default one before they're loaded.
+func retryPolicy() *config.RetryPolicy {
+	if policy, ok := currentRetryPolicy.Load().(*config.RetryPolicy); ok {
+		return policy
+	}
+	return config.DefaultRetryPolicy()
+}
+
+// retryer implements request.Retryer with the retry policy of the current settings.
+// It's shared by the CloudWatch, STS, EC2, Organizations and tagging clients.
+type retryer struct{}
+
+// withRetryer sets the retryer on a client configuration.
+// ShouldRetry is always called, so that the SDK doesn't decide on its own to retry some errors.
+func withRetryer(cfg *aws.Config) *aws.Config {
+	cfg = request.WithRetryer(cfg, retryer{})
+	cfg.EnforceShouldRetryCheck = aws.Bool(true)
+	return cfg
+}
+
+// errorCode returns the AWS error code of an error.
+func errorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return "Unknown"
+}
+
+// MaxRetries implements request.Retryer.
+func (retryer) MaxRetries() int {
+	return retryPolicy().MaxAttempts - 1
+}
+
+// ShouldRetry implements request.Retryer.
+func (retryer) ShouldRetry(req *request.Request) bool {
+	policy := retryPolicy()
+	code := errorCode(req.Error)
+
+	if config.Contains(policy.NoRetryCodes, code) {
+		return false
+	}
+	if config.Contains(policy.RetryCodes, code) {
+		return true
+	}
+	if req.HTTPResponse != nil && req.HTTPResponse.StatusCode >= 500 && req.HTTPResponse.StatusCode != 501 {
+		return true
+	}
+	return req.IsErrorRetryable() || req.IsErrorThrottle()
+}
+
+// RetryRules implements request.Retryer. It's only called when the request is retried, so the retry is counted here.
+func (retryer) RetryRules(req *request.Request) time.Duration {
+	policy := retryPolicy()
+	retries.WithLabelValues(req.Operation.Name, errorCode(req.Error)).Inc()
+
+	base := policy.BaseDelaySeconds
+	if req.IsErrorThrottle() {
+		base = policy.ThrottleDelaySeconds
+	}
+
+	delay := math.Min(base*math.Pow(2, float64(req.RetryCount)), policy.MaxDelaySeconds)
+	delay -= rand.Float64() * delay / 2
+	return time.Duration(delay * float64(time.Second))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// searchLabelSeparator separates the dimension values in the label of the series returned by a SEARCH expression.
+const searchLabelSeparator = "|~|"
+
+// searchQuoter escapes the characters which would end a quoted term of a SEARCH expression.
+var searchQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `'`, `\'`)
+
+// searchExpression returns the SEARCH expression listing the series of the metric for a statistic.
+// Dimensions selecting a single value are searched for that value, the others are selected once the results are returned.
+func searchExpression(configMetric *config.Metric, statistic string, target string) string {
+	schema := []string{fmt.Sprintf(`"%s"`, searchQuoter.Replace(configMetric.Namespace))}
+	for _, name := range configMetric.Dimensions {
+		schema = append(schema, fmt.Sprintf(`"%s"`, searchQuoter.Replace(name)))
+	}
+
+	terms := []string{
+		fmt.Sprintf("{%s}", strings.Join(schema, ",")),
+		fmt.Sprintf(`MetricName="%s"`, searchQuoter.Replace(configMetric.Name)),
+	}
+	for _, filter := range dimensionFilters(configMetric, target) {
+		if filter.Value != nil {
+			terms = append(terms, fmt.Sprintf(`%s="%s"`, aws.StringValue(filter.Name), searchQuoter.Replace(aws.StringValue(filter.Value))))
+		}
+	}
+
+	return fmt.Sprintf("SEARCH('%s', '%s', %d)", strings.Join(terms, " "), statistic, configMetric.PeriodSeconds)
+}
+
+// searchLabel returns the label template of the series returned by a SEARCH expression: the values of their dimensions, in the configured order.
+func searchLabel(configMetric *config.Metric) string {
+	properties := make([]string, 0, len(configMetric.Dimensions))
+	for _, name := range configMetric.Dimensions {
+		properties = append(properties, fmt.Sprintf("${PROP('Dim.%s')}", name))
+	}
+	return strings.Join(properties, searchLabelSeparator)
+}
+
+// newSearchQueries creates one SEARCH query per statistic of the metric.
+// The tagged resources and task labels are kept to create the queries of the series once they're returned.
+func newSearchQueries(configMetric *config.Metric, task *config.Task, tagged taggedResources) []*dataQuery {
+	var queries []*dataQuery
+
+	for _, query := range newDataQueries(configMetric, nil, appendTaskLabels(nil, task)) {
+		query.search = true
+		query.tagged = tagged
+		queries = append(queries, query)
+	}
+
+	return queries
+}
+
+// searchSeriesQuery returns the query of a series returned by a SEARCH query, from the label of the series.
+// It returns false if the series isn't selected by the dimensions selects or the tags of the metric.
+func searchSeriesQuery(query *dataQuery, label string, target string) (*dataQuery, bool) {
+	configMetric := query.metric
+
+	values := strings.Split(label, searchLabelSeparator)
+	if len(values) != len(configMetric.Dimensions) {
+		return nil, false
+	}
+
+	dimensions := make([]*cloudwatch.Dimension, 0, len(values))
+	for i, name := range configMetric.Dimensions {
+		if !dimensionMatches(configMetric, name, values[i], target) {
+			return nil, false
+		}
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(values[i]),
+		})
+	}
+
+	tagLabels, ok := query.tagged.tagLabels(configMetric, dimensions)
+	if !ok {
+		return nil, false
+	}
+
+	// The query holds the task labels, followed by the statistic in label mode
+	labels := append(append(append([]string{}, values...), tagLabels...), query.labels...)
+
+	series := *query
+	series.dimensions = dimensions
+	series.labels = labels
+	series.search = false
+	return &series, true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+func TestSearchExpression(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   config.Metric
+		target   string
+		expected string
+	}{
+		{
+			name:     "no select",
+			metric:   config.Metric{Namespace: "AWS/Lambda", Name: "Errors", Dimensions: []string{"FunctionName"}, PeriodSeconds: 60},
+			expected: `SEARCH('{"AWS/Lambda","FunctionName"} MetricName="Errors"', 'Sum', 60)`,
+		},
+		{
+			name: "single select value",
+			metric: config.Metric{
+				Namespace:        "AWS/Lambda",
+				Name:             "Errors",
+				Dimensions:       []string{"FunctionName", "Resource"},
+				DimensionsSelect: map[string][]string{"FunctionName": {"api"}, "Resource": {"api:1", "api:2"}},
+				PeriodSeconds:    300,
+			},
+			expected: `SEARCH('{"AWS/Lambda","FunctionName","Resource"} MetricName="Errors" FunctionName="api"', 'Sum', 300)`,
+		},
+		{
+			name: "select regex",
+			metric: config.Metric{
+				Namespace:             "AWS/Lambda",
+				Name:                  "Errors",
+				Dimensions:            []string{"FunctionName"},
+				DimensionsSelect:      map[string][]string{"FunctionName": {"api"}},
+				DimensionsSelectRegex: map[string]string{"FunctionName": "api-.*"},
+				PeriodSeconds:         60,
+			},
+			expected: `SEARCH('{"AWS/Lambda","FunctionName"} MetricName="Errors"', 'Sum', 60)`,
+		},
+		{
+			name: "quoted target",
+			metric: config.Metric{
+				Namespace:        "Custom",
+				Name:             "Requests",
+				Dimensions:       []string{"Service"},
+				DimensionsSelect: map[string][]string{"Service": {"$_target"}},
+				PeriodSeconds:    60,
+			},
+			target:   `it's "quoted"\`,
+			expected: `SEARCH('{"Custom","Service"} MetricName="Requests" Service="it\'s \"quoted\"\\"', 'Sum', 60)`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if expression := searchExpression(&test.metric, "Sum", test.target); expression != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, expression)
+			}
+		})
+	}
+}
+
+func TestSearchLabel(t *testing.T) {
+	metric := &config.Metric{Dimensions: []string{"FunctionName", "Resource"}}
+	expected := "${PROP('Dim.FunctionName')}|~|${PROP('Dim.Resource')}"
+	if label := searchLabel(metric); label != expected {
+		t.Errorf("expected %s, got %s", expected, label)
+	}
+}
+
+func TestSearchSeriesQuery(t *testing.T) {
+	metric := &config.Metric{
+		Namespace:        "AWS/Lambda",
+		Name:             "Errors",
+		Dimensions:       []string{"FunctionName", "Resource"},
+		DimensionsSelect: map[string][]string{"Resource": {"$_target"}},
+		DimensionsRegexps: map[string]*regexp.Regexp{
+			"FunctionName": regexp.MustCompile("api-.*"),
+		},
+		TagSelect: &config.TagSelect{ResourceIDDimension: "FunctionName"},
+	}
+
+	tests := []struct {
+		name     string
+		label    string
+		tagged   taggedResources
+		expected []string
+	}{
+		{
+			name:     "selected series",
+			label:    "api-prod|~|api-prod:live",
+			expected: []string{"api-prod", "api-prod:live", "lambda", "eu-west-1", "Sum"},
+		},
+		{
+			name:  "regex mismatch",
+			label: "worker|~|api-prod:live",
+		},
+		{
+			name:  "select mismatch",
+			label: "api-prod|~|api-prod:test",
+		},
+		{
+			name:  "missing dimension",
+			label: "api-prod",
+		},
+		{
+			name:     "tagged resource",
+			label:    "api-prod|~|api-prod:live",
+			tagged:   taggedResources{"api-prod": {"data"}},
+			expected: []string{"api-prod", "api-prod:live", "data", "lambda", "eu-west-1", "Sum"},
+		},
+		{
+			name:   "untagged resource",
+			label:  "api-prod|~|api-prod:live",
+			tagged: taggedResources{"api-staging": {"data"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := &dataQuery{
+				metric:    metric,
+				labels:    []string{"lambda", "eu-west-1", "Sum"},
+				statistic: "Sum",
+				search:    true,
+				tagged:    test.tagged,
+			}
+
+			series, ok := searchSeriesQuery(query, test.label, "api-prod:live")
+			if test.expected == nil {
+				if ok {
+					t.Errorf("expected the series to be skipped, got %v", series.labels)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("expected a series, got none")
+			}
+			if series.search || len(series.dimensions) != 2 {
+				t.Errorf("expected a series query with 2 dimensions, got %d dimensions and search %t", len(series.dimensions), series.search)
+			}
+			if !reflect.DeepEqual(series.labels, test.expected) {
+				t.Errorf("expected labels %v, got %v", test.expected, series.labels)
+			}
+			if !query.search || len(query.dimensions) != 0 {
+				t.Error("expected the search query to be left unchanged")
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+
+	"github.com/mtlang/cloudwatch_exporter/config"
+)
+
+// taggedResources maps the dimension value of each resource selected by its tags to the values of its exported tags.
+type taggedResources map[string][]string
+
+// getTaggedResources requests the resources of the task's account and region matching the tag selections of the metric.
+func getTaggedResources(ctx context.Context, collector *Collector, task *config.Task, configMetric *config.Metric) (taggedResources, error) {
+	tagSelect := configMetric.TagSelect
+	svc := clients.getTagging(task.Account, task.RoleName, task.Region)
+
+	params := &resourcegroupstaggingapi.GetResourcesInput{}
+	if len(tagSelect.ResourceTypeSelection) > 0 {
+		params.ResourceTypeFilters = []*string{aws.String(tagSelect.ResourceTypeSelection)}
+	}
+	for key, values := range tagSelect.TagSelections {
+		filter := &resourcegroupstaggingapi.TagFilter{
+			Key: aws.String(key),
+		}
+		for _, value := range values {
+			filter.Values = append(filter.Values, aws.String(value))
+		}
+		params.TagFilters = append(params.TagFilters, filter)
+	}
+
+	resources := taggedResources{}
+	for {
+		page, err := svc.GetResourcesWithContext(ctx, params, limiter.attempts(apiGetResources, task.Account, task.Region))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			collector.ErroneousRequests.Inc()
+			return nil, err
+		}
+
+		for _, mapping := range page.ResourceTagMappingList {
+			tags := map[string]string{}
+			for _, tag := range mapping.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+
+			exported := make([]string, 0, len(tagSelect.ExportTags))
+			for _, key := range tagSelect.ExportTags {
+				exported = append(exported, tags[key])
+			}
+
+			resources[tagSelect.ResourceID(configMetric.Namespace, aws.StringValue(mapping.ResourceARN))] = exported
+		}
+
+		if aws.StringValue(page.PaginationToken) == "" {
+			break
+		}
+		params.PaginationToken = page.PaginationToken
+	}
+
+	return resources, nil
+}
+
+// tagLabels returns the values of the exported tags of the resource identified by the dimensions.
+// It returns false if the resource isn't selected by its tags. Metrics without tag selection are always selected.
+func (resources taggedResources) tagLabels(configMetric *config.Metric, dimensions []*cloudwatch.Dimension) ([]string, bool) {
+	if resources == nil {
+		return nil, true
+	}
+
+	for _, dim := range dimensions {
+		if aws.StringValue(dim.Name) == configMetric.TagSelect.ResourceIDDimension {
+			values, ok := resources[aws.StringValue(dim.Value)]
+			return values, ok
+		}
+	}
+	return nil, false
+}
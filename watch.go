@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reloadConfig reloads the configuration the same way /reload does and logs the outcome.
+func reloadConfig(reason string) {
+	err := loadConfigFile()
+	if err != nil {
+		log.Printf("Can't reload configuration file after %s: %s\n", reason, err.Error())
+		return
+	}
+	log.Printf("Configuration reloaded after %s\n", reason)
+}
+
+// watchSignals reloads the configuration every time the process receives SIGHUP.
+func watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		reloadConfig("SIGHUP")
+	}
+}
+
+// fileChecksum returns the checksum of the content of a file.
+// The file is read through its path so that symlink swaps, as done by Kubernetes ConfigMap mounts, are seen.
+func fileChecksum(filename string) ([sha256.Size]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(content), nil
+}
+
+// watchConfigFile reloads the configuration when the content of the file changes.
+// A change is only acted upon once the content stayed the same for a full interval, so partial writes don't trigger a reload.
+func watchConfigFile(filename string, interval time.Duration) {
+	last, _ := fileChecksum(filename)
+	pending := last
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sum, err := fileChecksum(filename)
+		if err != nil {
+			// The file can briefly disappear while it's being replaced
+			continue
+		}
+
+		if sum == last {
+			pending = last
+			continue
+		}
+
+		if sum != pending {
+			pending = sum
+			continue
+		}
+
+		// Don't retry a broken file on every tick, wait for it to change again
+		last = sum
+		reloadConfig("configuration file change")
+	}
+}